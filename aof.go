@@ -1,88 +1,577 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Aof is a multi-part AOF: a directory holding a base file, the incremental
+// files appended to since, and a manifest listing them. Rewrites start a new
+// incremental file and write a new base, so no write is logged twice.
 type Aof struct {
 	w    *Writer
-	f    *os.File
-	conf *Config
+	f    *os.File // the incremental file being appended to
+	conf func() *Config
+	mu   sync.Mutex
+	dir  string
+
+	manifest  *aofManifest
+	rewriting bool
+	// lastTimestamp is the time of the last timestamp annotation written to
+	// the current incremental file
+	lastTimestamp int64
+	// appended counts the records appended, and synced how many of them
+	// are known to be on disk
+	appended atomic.Int64
+	synced   int64
+	// syncMu guards synced and syncing, and syncDone is broadcast when an
+	// fsync finishes
+	syncMu        sync.Mutex
+	syncDone      *sync.Cond
+	syncing       bool
+	delayedFsyncs atomic.Int64
+	// baseSize is the size of the AOF after the last rewrite, or at startup
+	baseSize atomic.Int64
+}
+
+// NewAof opens the AOF in conf's dir. Writes would go unlogged if it can't be
+// opened, so the server must not start.
+func NewAof(conf func() *Config) (*Aof, error) {
+	aof := Aof{conf: conf, dir: path.Join(conf().dir, conf().aofDirname)}
+	aof.syncDone = sync.NewCond(&aof.syncMu)
+
+	if err := aof.open(); err != nil {
+		return nil, fmt.Errorf("cannot open AOF: %w", err)
+	}
+
+	return &aof, nil
+}
+
+func (aof *Aof) manifestName() string {
+	return aof.conf().aofFn + ".manifest"
 }
 
-func NewAof(conf *Config) *Aof {
-	aof := Aof{conf: conf}
+// open loads the manifest and opens the last incremental file for appending.
+// An AOF left by older versions in dir becomes the base file.
+func (aof *Aof) open() error {
+	if err := os.MkdirAll(aof.dir, 0755); err != nil {
+		return err
+	}
+
+	legacy := path.Join(aof.conf().dir, aof.conf().aofFn)
+
+	m, err := parseManifest(path.Join(aof.dir, aof.manifestName()))
+	if errors.Is(err, fs.ErrNotExist) {
+		m = &aofManifest{}
+		if _, err := os.Stat(legacy); err == nil {
+			log.Println("upgrading AOF to the multi-part layout: ", legacy)
+			m.base = &aofFile{name: aof.conf().aofFn, seq: 1, typ: aofBase}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	aof.manifest = m
+	if len(m.incrs) == 0 {
+		m.incrs = append(m.incrs, &aofFile{name: aof.incrName(1), seq: 1, typ: aofIncr})
+	}
+	if err := writeManifest(aof.dir, aof.manifestName(), m); err != nil {
+		return err
+	}
+
+	// the manifest is written before the old AOF is moved, so a crash in
+	// between finishes the move on the next start
+	if m.base != nil && m.base.name == aof.conf().aofFn {
+		if _, err := os.Stat(path.Join(aof.dir, m.base.name)); errors.Is(err, fs.ErrNotExist) {
+			if err := os.Rename(legacy, path.Join(aof.dir, m.base.name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	aof.removeHistory()
 
-	fp := path.Join(aof.conf.dir, aof.conf.aofFn)
-	f, err := os.OpenFile(fp, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644) // owner (read-write), everyone (read)
+	last := m.incrs[len(m.incrs)-1]
+	f, err := os.OpenFile(path.Join(aof.dir, last.name), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644) // owner (read-write), everyone (read)
 	if err != nil {
-		fmt.Println("cannot open: ", fp)
-		return &aof
+		return err
 	}
-	aof.w = NewWriter(f)
 	aof.f = f
+	aof.w = NewWriter(f)
+	aof.baseSize.Store(aof.sizeLocked())
+
+	return nil
+}
+
+// size returns the size of the files that make up the AOF, plus writes not
+// yet flushed to them.
+func (aof *Aof) size() int64 {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	return aof.sizeLocked()
+}
+
+func (aof *Aof) sizeLocked() int64 {
+	if aof.manifest == nil {
+		return 0
+	}
+
+	var size int64
+	for _, file := range aof.manifest.files() {
+		if info, err := os.Stat(path.Join(aof.dir, file.name)); err == nil {
+			size += info.Size()
+		}
+	}
+	if aof.w != nil {
+		size += int64(aof.w.Buffered())
+	}
+	return size
+}
+
+func (aof *Aof) incrName(seq int) string {
+	return fmt.Sprintf("%s.%d.incr.aof", aof.conf().aofFn, seq)
+}
+
+func (aof *Aof) baseName(seq int) string {
+	return fmt.Sprintf("%s.%d.base.aof", aof.conf().aofFn, seq)
+}
+
+// removeHistory deletes the files a rewrite dropped from the manifest. The
+// caller must hold aof.mu, or be opening the AOF.
+func (aof *Aof) removeHistory() {
+	if len(aof.manifest.history) == 0 {
+		return
+	}
 
-	return &aof
+	for _, file := range aof.manifest.history {
+		log.Println("removing old AOF file: ", file.name)
+		if err := os.Remove(path.Join(aof.dir, file.name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("cannot remove old AOF file: ", err)
+			return
+		}
+	}
+
+	aof.manifest.history = nil
+	if err := writeManifest(aof.dir, aof.manifestName(), aof.manifest); err != nil {
+		log.Println("cannot write AOF manifest: ", err)
+	}
+}
+
+// Sync replays the AOF into the database, the base file first and then each
+// incremental file. Each record is dispatched through the command table on a
+// replay client, against a state with no AOF of its own, so nothing is
+// logged twice.
+func (aof *Aof) Sync(maxmem int64, evictionpolicy Eviction, memsamples int) error {
+	if aof.manifest == nil {
+		return nil
+	}
+
+	replayState, err := NewAppState(&Config{
+		maxmem:          maxmem,
+		eviction:        evictionpolicy,
+		memSamples:      memsamples,
+		protoMaxBulkLen: aof.conf().protoMaxBulkLen,
+	})
+	if err != nil {
+		return err
+	}
+	c := NewReplayClient(replayState)
+
+	files := aof.manifest.files()
+	for i, file := range files {
+		log.Println("loading AOF file: ", file.name)
+		err := aof.replayFile(file, i == len(files)-1, c, replayState)
+		if err != nil {
+			return fmt.Errorf("cannot load AOF file %s: %w", file.name, err)
+		}
+	}
+
+	return nil
 }
 
-func (aof *Aof) Sync(maxmem int64, evictionpolicy Eviction, memsamples int) {
-	r := bufio.NewReader(aof.f)
+// replayFile replays one file of the AOF. A last file that ends mid-record,
+// as left by a crash, is cut back to its last complete record if
+// aof-load-truncated is set.
+func (aof *Aof) replayFile(file *aofFile, last bool, c *Client, state *AppState) error {
+	fp := path.Join(aof.dir, file.name)
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ar := newAofReader(f, aof.conf().protoMaxBulkLen)
 	for {
-		v := Value{}
-		err := v.readArray(r)
+		valid := ar.offset()
+		v, err := ar.next()
 		if err == io.EOF {
-			break
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF && last {
+			if !aof.conf().aofLoadTruncated {
+				return errAofTruncated
+			}
+			log.Printf("AOF %s is truncated, loaded up to offset %d and discarding the rest", file.name, valid)
+			return truncateAof(fp, valid)
 		}
 		if err != nil {
-			log.Println("unexpected error while reading AOF records: ", err)
-			break
+			return fmt.Errorf("%w at offset %d, use check-aof to inspect it", err, valid)
+		}
+
+		cmd := strings.ToUpper(v.array[0].bulk)
+		handler, ok := Handlers[cmd]
+		if !ok || !contains(WriteCMDs, cmd) {
+			return fmt.Errorf("unknown command '%s' at offset %d", v.array[0].bulk, valid)
 		}
+		v.array[0].bulk = cmd
 
-		blankState := NewAppState(&Config{
-			maxmem:     maxmem,
-			eviction:   evictionpolicy,
-			memSamples: memsamples,
-		})
-		blankClient := Client{}
-		set(&blankClient, &v, blankState)
+		reply := handler(c, v, state)
+		if reply != nil && reply.typ == ERROR {
+			log.Printf("error replaying AOF record %s: %s", cmd, reply.err)
+		}
 	}
 }
 
-func (aof *Aof) Rewrite(cp map[string]*Item) {
-	// reroute future AOF records to buffer
-	var b bytes.Buffer
-	aof.w = NewWriter(&b)
-
-	// clear file contents
-	if err := aof.f.Truncate(0); err != nil {
-		log.Println("aof rewrite - truncate error: ", err)
+// propagate appends a write command to the AOF. Commands must be logged in a
+// form that replays to the same result, so relative expiries are logged as
+// PEXPIREAT. Callers hold the DB write lock, which keeps records in the
+// order their writes were applied.
+func propagate(state *AppState, args ...string) {
+	if state.aof == nil || state.aof.w == nil {
 		return
 	}
-	if _, err := aof.f.Seek(0, 0); err != nil {
-		log.Println("aof rewrite - seek error: ", err)
+	state.aof.append(args)
+}
+
+func (aof *Aof) append(args []string) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.conf().aofTimestampEnabled {
+		if now := time.Now().Unix(); now != aof.lastTimestamp {
+			aof.w.writeString(timestampAnnotation(now))
+			aof.lastTimestamp = now
+		}
+	}
+	aof.w.Write(commandValue(args...))
+	aof.appended.Add(1)
+}
+
+// rewriteAofBackground starts a rewrite of the AOF in the background.
+func rewriteAofBackground(state *AppState) error {
+	// the snapshot and the switch to a new incremental file must see the
+	// same writes, so both happen under the lock
+	DB.mu.RLock()
+	if err := state.aof.startRewrite(); err != nil {
+		DB.mu.RUnlock()
+		return err
+	}
+	snap := DB.snapshot()
+	DB.mu.RUnlock()
+
+	state.aofRewriteRunning.Store(true)
+	go func() {
+		start := time.Now()
+		defer func() {
+			snap.release()
+			state.aofRewriteRunning.Store(false)
+			state.aofStats.aof_last_rewrite_time_sec.Store(int64(time.Since(start).Seconds()))
+		}()
+
+		if err := state.aof.Rewrite(snap); err != nil {
+			log.Println("aof rewrite failed: ", err)
+			state.aofStats.aof_last_bgrewrite_status.Store("err")
+			return
+		}
+
+		state.aofStats.aof_last_bgrewrite_status.Store("ok")
+		state.aofStats.aof_rewrites.Add(1)
+	}()
+
+	return nil
+}
+
+// InitAofAutoRewrite starts rewriting the AOF whenever it outgrows
+// auto-aof-rewrite-percentage and auto-aof-rewrite-min-size. It's called once
+// the AOF is loaded, so a rewrite never snapshots a partly loaded dataset.
+func InitAofAutoRewrite(state *AppState) {
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+
+		for range t.C {
+			size, growth, due := aofRewriteDue(state)
+			if !due {
+				continue
+			}
+
+			log.Printf("starting automatic AOF rewrite, grown by %d%% to %d bytes", growth, size)
+			if err := rewriteAofBackground(state); err != nil {
+				log.Println("cannot start automatic AOF rewrite: ", err)
+			}
+		}
+	}()
+}
+
+// aofRewriteDue reports whether the AOF has grown enough since its last
+// rewrite to rewrite it again, along with its size and percentage growth.
+func aofRewriteDue(state *AppState) (size int64, growth int64, due bool) {
+	conf := state.conf()
+	if conf.aofRewritePerc == 0 || state.aofRewriteRunning.Load() {
+		return 0, 0, false
+	}
+
+	size, base := state.aof.size(), state.aof.baseSize.Load()
+	if size < conf.aofRewriteMinSize {
+		return size, 0, false
+	}
+	if base == 0 {
+		base = 1
+	}
+
+	growth = (size - base) * 100 / base
+	return size, growth, growth >= int64(conf.aofRewritePerc)
+}
+
+// startRewrite switches appends to a new incremental file, which will follow
+// the rewritten base. The snapshot for Rewrite must be taken at the same
+// time, with writes held off. It fails if a rewrite is already running.
+func (aof *Aof) startRewrite() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.rewriting {
+		return errors.New("Background append only file rewriting already in progress")
+	}
+	if aof.w == nil {
+		return errors.New("AOF is not open")
+	}
+
+	// the old file is done with, so its writes are made durable before it's
+	// closed, instead of by an fsync that would find it closed
+	if err := aof.w.Flush(); err != nil {
+		return err
+	}
+	if err := aof.f.Sync(); err != nil {
+		return err
+	}
+
+	incr := &aofFile{name: aof.incrName(aof.manifest.incrSeq() + 1), seq: aof.manifest.incrSeq() + 1, typ: aofIncr}
+	f, err := os.OpenFile(path.Join(aof.dir, incr.name), os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	// the file must be in the manifest before anything is written to it
+	aof.manifest.incrs = append(aof.manifest.incrs, incr)
+	if err := writeManifest(aof.dir, aof.manifestName(), aof.manifest); err != nil {
+		aof.manifest.incrs = aof.manifest.incrs[:len(aof.manifest.incrs)-1]
+		f.Close()
+		os.Remove(path.Join(aof.dir, incr.name))
+		return err
+	}
+
+	aof.f.Close()
+	aof.f = f
+	aof.w = NewWriter(f)
+	aof.rewriting = true
+	aof.lastTimestamp = 0
+
+	return nil
+}
+
+// Rewrite writes snap as a new base file, then drops the old base and the
+// incremental files it replaces. The base is built under a temporary name, so
+// a crash at any point leaves the old AOF intact.
+func (aof *Aof) Rewrite(snap *Snapshot) error {
+	defer func() {
+		aof.mu.Lock()
+		aof.rewriting = false
+		aof.mu.Unlock()
+	}()
+
+	tmp := path.Join(aof.dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	var ts int64
+	if aof.conf().aofTimestampEnabled {
+		ts = snap.Time.Unix()
+	}
+	if err := writeBase(tmp, snap.All(), ts); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	m := aof.manifest
+	base := &aofFile{name: aof.baseName(m.baseSeq() + 1), seq: m.baseSeq() + 1, typ: aofBase}
+	if err := os.Rename(tmp, path.Join(aof.dir, base.name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// everything before the incremental file started by startRewrite is
+	// now in the base
+	next := aofManifest{base: base, incrs: m.incrs[len(m.incrs)-1:], history: m.history}
+	if m.base != nil {
+		next.history = append(next.history, &aofFile{name: m.base.name, seq: m.base.seq, typ: aofHistory})
+	}
+	for _, incr := range m.incrs[:len(m.incrs)-1] {
+		next.history = append(next.history, &aofFile{name: incr.name, seq: incr.seq, typ: aofHistory})
+	}
+
+	if err := writeManifest(aof.dir, aof.manifestName(), &next); err != nil {
+		os.Remove(path.Join(aof.dir, base.name))
+		return err
+	}
+	aof.manifest = &next
+	aof.removeHistory()
+	aof.baseSize.Store(aof.sizeLocked())
+
+	return nil
+}
+
+// writeBase writes the dataset as SET and PEXPIREAT commands, and fsyncs it.
+// A non-zero ts is written first, as the time the snapshot was taken.
+func writeBase(fp string, items iter.Seq2[string, *Item], ts int64) error {
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := NewWriter(f)
+	if ts != 0 {
+		w.writeString(timestampAnnotation(ts))
+	}
+	for k, v := range items {
+		if v.shouldExpire() {
+			continue
+		}
+
+		w.Write(commandValue("SET", k, v.V))
+		if v.Exp.Unix() != UNIX_TS_EPOCH {
+			w.Write(commandValue("PEXPIREAT", k, strconv.FormatInt(v.Exp.UnixMilli(), 10)))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// commit makes the records appended so far as durable as appendfsync asks,
+// before the writes they record are acknowledged. With always they're
+// fsynced, and otherwise written to the file for the OS to sync.
+func (aof *Aof) commit() error {
+	if aof.conf().aofFsync == Always {
+		return aof.waitSync(aof.appended.Load())
+	}
+	return aof.Flush()
+}
+
+// waitSync blocks until the first n records appended are on disk. This is a
+// group commit: callers that arrive during an fsync wait for it to finish,
+// and the next fsync then covers all of their records at once.
+func (aof *Aof) waitSync(n int64) error {
+	aof.syncMu.Lock()
+	defer aof.syncMu.Unlock()
+
+	for aof.synced < n {
+		if aof.syncing {
+			aof.syncDone.Wait()
+			continue
+		}
+
+		aof.syncing = true
+		aof.syncMu.Unlock()
+		covered, err := aof.fsync()
+		aof.syncMu.Lock()
+
+		aof.syncing = false
+		aof.syncDone.Broadcast()
+		if err != nil {
+			return err
+		}
+		aof.synced = max(aof.synced, covered)
+	}
+
+	return nil
+}
+
+// fsync writes the buffered records to the file and fsyncs it, returning how
+// many records that covers. Only the flush holds aof.mu, so writes carry on
+// during the fsync.
+func (aof *Aof) fsync() (int64, error) {
+	aof.mu.Lock()
+	if aof.w == nil {
+		aof.mu.Unlock()
+		return 0, nil
+	}
+	covered := aof.appended.Load()
+	err := aof.w.Flush()
+	f := aof.f
+	aof.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = f.Sync()
+	// a rewrite closes the file after syncing it itself
+	if errors.Is(err, os.ErrClosed) {
+		err = nil
+	}
+	return covered, err
+}
+
+// backgroundSync fsyncs everything appended so far without waiting for it,
+// for appendfsync everysec. If the last fsync is still running, the disk is
+// falling behind, and it's counted as a delayed fsync instead.
+func (aof *Aof) backgroundSync() {
+	aof.syncMu.Lock()
+	if aof.syncing {
+		aof.syncMu.Unlock()
+		aof.delayedFsyncs.Add(1)
 		return
 	}
+	aof.syncMu.Unlock()
 
-	// write all SET commands to file
-	fwriter := NewWriter(aof.f)
-	for k, v := range cp {
-		cmd := Value{typ: BULK, bulk: "SET"}
-		key := Value{typ: BULK, bulk: k}
-		val := Value{typ: BULK, bulk: v.V}
+	go func() {
+		if err := aof.waitSync(aof.appended.Load()); err != nil {
+			log.Println("error syncing AOF: ", err)
+		}
+	}()
+}
 
-		arr := Value{typ: ARRAY, array: []Value{
-			cmd, key, val,
-		}}
-		fwriter.Write(&arr)
+// Flush writes buffered records to the file.
+func (aof *Aof) Flush() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.w == nil {
+		return nil
 	}
-	fwriter.Flush()
+	return aof.w.Flush()
+}
 
-	// reroute future AOF records back to file
-	aof.w = NewWriter(aof.f)
+// syncDir fsyncs a directory, so a rename inside it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
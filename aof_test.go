@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newAofConfig returns a config with the AOF enabled in a temporary dir.
+func newAofConfig(t *testing.T) *Config {
+	t.Helper()
+
+	conf := NewConfig()
+	conf.dir = t.TempDir()
+	conf.aofEnabled = true
+	return conf
+}
+
+func TestNewAppStateAofOpenError(t *testing.T) {
+	conf := newAofConfig(t)
+	dir := path.Join(conf.dir, conf.aofDirname)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, conf.aofFn+".manifest"), []byte("file x seq 1 type q\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	DB = NewDatabase()
+	if _, err := NewAppState(conf); err == nil {
+		t.Error("started with an AOF that can't be opened")
+	}
+}
+
+// startAof resets the database and loads the AOF in conf, as the server does
+// at startup.
+func startAof(t *testing.T, conf *Config) *AppState {
+	t.Helper()
+
+	DB = NewDatabase()
+	state, err := NewAppState(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.aof.Sync(conf.maxmem, conf.eviction, conf.memSamples); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// runCommands runs each command as a client would, through the command table.
+func runCommands(t *testing.T, state *AppState, cmds ...[]string) {
+	t.Helper()
+
+	c := NewReplayClient(state)
+	for _, cmd := range cmds {
+		handle(c, commandValue(cmd...), state)
+	}
+	if err := state.aof.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dataset returns the value and expiry of every key in the database.
+func dataset() map[string]string {
+	DB.mu.RLock()
+	defer DB.mu.RUnlock()
+
+	keys := map[string]string{}
+	for k, item := range DB.store {
+		keys[k] = item.V
+		if item.Exp.Unix() != UNIX_TS_EPOCH {
+			keys[k] += fmt.Sprintf(" px %d", item.Exp.UnixMilli())
+		}
+	}
+	return keys
+}
+
+func TestAofReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		cmds [][]string
+	}{
+		{"sets and deletes", [][]string{
+			{"SET", "a", "1"}, {"SET", "b", "2"}, {"DEL", "a"}, {"set", "b", "3"}, {"SET", "c", "x y\r\nz"},
+		}},
+		{"expiry", [][]string{
+			{"SET", "k", "v"}, {"EXPIRE", "k", "100"}, {"SET", "gone", "v"}, {"PEXPIREAT", "gone", "1"},
+		}},
+		{"flush", [][]string{
+			{"SET", "a", "1"}, {"FLUSHDB"}, {"SET", "b", "2"},
+		}},
+		{"reads only", [][]string{
+			{"GET", "a"}, {"EXISTS", "a"},
+		}},
+	}
+
+	for _, tt := range tests {
+		conf := newAofConfig(t)
+		state := startAof(t, conf)
+		runCommands(t, state, tt.cmds...)
+		want := dataset()
+
+		startAof(t, conf)
+		if got := dataset(); !maps.Equal(got, want) {
+			t.Errorf("%s: loaded %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+// startRewrite starts a rewrite as BGREWRITEAOF does, and returns the
+// snapshot it will write.
+func startRewrite(t *testing.T, state *AppState) *Snapshot {
+	t.Helper()
+
+	DB.mu.RLock()
+	defer DB.mu.RUnlock()
+	if err := state.aof.startRewrite(); err != nil {
+		t.Fatal(err)
+	}
+	return DB.snapshot()
+}
+
+func TestAofRewrite(t *testing.T) {
+	tmpName := fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid())
+
+	tests := []struct {
+		name string
+		// rewrite finishes the rewrite started with snap, or stops it as a
+		// crash would, and reports whether it should have succeeded
+		rewrite func(t *testing.T, state *AppState, snap *Snapshot) bool
+	}{
+		{"completes", func(t *testing.T, state *AppState, snap *Snapshot) bool {
+			return state.aof.Rewrite(snap) == nil
+		}},
+		{"crashes while writing the base", func(t *testing.T, state *AppState, snap *Snapshot) bool {
+			tmp := path.Join(state.aof.dir, tmpName)
+			if err := os.WriteFile(tmp, []byte("*3\r\n$3\r\nSET\r\n$1\r\na"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			return false
+		}},
+		{"can't write the base", func(t *testing.T, state *AppState, snap *Snapshot) bool {
+			// a directory in the way of the temporary file
+			if err := os.Mkdir(path.Join(state.aof.dir, tmpName), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := state.aof.Rewrite(snap); err == nil {
+				t.Error("rewrite succeeded without a base file")
+			}
+			return false
+		}},
+	}
+
+	for _, tt := range tests {
+		conf := newAofConfig(t)
+		state := startAof(t, conf)
+		runCommands(t, state, []string{"SET", "a", "1"}, []string{"SET", "b", "2"}, []string{"SET", "c", "3"})
+
+		snap := startRewrite(t, state)
+		// writes made while the base is written go to the new incremental
+		// file only
+		runCommands(t, state, []string{"SET", "b", "changed"}, []string{"DEL", "a"}, []string{"SET", "d", "4"})
+		ok := tt.rewrite(t, state, snap)
+		snap.release()
+
+		// and so do writes after it
+		runCommands(t, state, []string{"SET", "e", "5"})
+		want := dataset()
+
+		files := len(state.aof.manifest.files())
+		if ok && files != 2 {
+			t.Errorf("%s: AOF has %d files after the rewrite, want a base and an incremental file", tt.name, files)
+		}
+
+		startAof(t, conf)
+		if got := dataset(); !maps.Equal(got, want) {
+			t.Errorf("%s: loaded %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+// rewriteAof runs BGREWRITEAOF and waits for it to finish.
+func rewriteAof(t *testing.T, state *AppState) {
+	t.Helper()
+
+	c := NewReplayClient(state)
+	if reply := bgrewriteaof(c, commandValue("BGREWRITEAOF"), state); reply.typ == ERROR {
+		t.Fatal(reply.err)
+	}
+	for state.aofRewriteRunning.Load() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAofManifestAfterRewrite(t *testing.T) {
+	conf := newAofConfig(t)
+	state := startAof(t, conf)
+	dir := path.Join(conf.dir, conf.aofDirname)
+
+	runCommands(t, state, []string{"SET", "a", "1"})
+	rewriteAof(t, state)
+	runCommands(t, state, []string{"SET", "b", "2"})
+	rewriteAof(t, state)
+	runCommands(t, state, []string{"SET", "c", "3"})
+
+	manifest, err := os.ReadFile(path.Join(dir, "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "file appendonly.aof.2.base.aof seq 2 type b\nfile appendonly.aof.3.incr.aof seq 3 type i\n"
+	if string(manifest) != want {
+		t.Errorf("manifest is %q, want %q", manifest, want)
+	}
+
+	// the files the rewrites replaced are gone
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"appendonly.aof.2.base.aof", "appendonly.aof.3.incr.aof", "appendonly.aof.manifest"}; !slices.Equal(names, want) {
+		t.Errorf("AOF dir holds %v, want %v", names, want)
+	}
+
+	startAof(t, conf)
+	if got, want := dataset(), map[string]string{"a": "1", "b": "2", "c": "3"}; !maps.Equal(got, want) {
+		t.Errorf("loaded %v, want %v", got, want)
+	}
+}
+
+func TestAofLegacyUpgrade(t *testing.T) {
+	conf := newAofConfig(t)
+
+	var legacy bytes.Buffer
+	w := NewBufferWriter(&legacy)
+	w.Write(commandValue("SET", "a", "1"))
+	w.Write(commandValue("SET", "b", "2"))
+	if err := os.WriteFile(path.Join(conf.dir, conf.aofFn), legacy.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state := startAof(t, conf)
+	runCommands(t, state, []string{"DEL", "a"})
+
+	// the old file becomes the base, under its own name
+	m := state.aof.manifest
+	if m.base == nil || m.base.name != conf.aofFn || len(m.incrs) != 1 || m.incrs[0].name != "appendonly.aof.1.incr.aof" {
+		t.Errorf("manifest is %q", m.encode())
+	}
+	if _, err := os.Stat(path.Join(conf.dir, conf.aofFn)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("old AOF left in place: %v", err)
+	}
+
+	startAof(t, conf)
+	if got, want := dataset(), map[string]string{"b": "2"}; !maps.Equal(got, want) {
+		t.Errorf("loaded %v, want %v", got, want)
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		manifest string
+		valid    bool
+	}{
+		{"file a.base seq 1 type b\nfile a.incr.1 seq 1 type i\nfile a.incr.2 seq 2 type i\n", true},
+		{"# comment\n\nfile old seq 1 type h\nfile a.incr.3 seq 3 type i\n", true},
+		{"file a seq 1 type b\nfile b seq 2 type b\n", false},
+		{"file a seq 2 type i\nfile b seq 1 type i\n", false},
+		{"file a seq 1 type x\n", false},
+		{"file ../a seq 1 type i\n", false},
+		{"file a seq -1 type i\n", false},
+		{"file a seq 1 type\n", false},
+	}
+
+	for _, tt := range tests {
+		fp := path.Join(t.TempDir(), "manifest")
+		if err := os.WriteFile(fp, []byte(tt.manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := parseManifest(fp)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: err %v", tt.manifest, err)
+		}
+	}
+}
+
+// appendToAof appends raw bytes to the AOF's current incremental file, as a
+// crash mid-write or a damaged disk would leave them.
+func appendToAof(t *testing.T, state *AppState, data string) string {
+	t.Helper()
+
+	m := state.aof.manifest
+	fp := path.Join(state.aof.dir, m.incrs[len(m.incrs)-1].name)
+	f, err := os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	return fp
+}
+
+func TestAofLoadTruncated(t *testing.T) {
+	tests := []struct {
+		loadTruncated bool
+		tail          string
+		loads         bool
+	}{
+		{true, "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1", true},
+		{true, "*3\r\n$3\r\nSE", true},
+		{false, "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1", false},
+		// damage that isn't a cut off write is never skipped
+		{true, "+garbage\r\n*1\r\n$4\r\nPING\r\n", false},
+	}
+
+	for _, tt := range tests {
+		conf := newAofConfig(t)
+		state := startAof(t, conf)
+		runCommands(t, state, []string{"SET", "a", "1"}, []string{"SET", "b", "2"})
+		fp := appendToAof(t, state, "")
+		info, err := os.Stat(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appendToAof(t, state, tt.tail)
+
+		conf.aofLoadTruncated = tt.loadTruncated
+		DB = NewDatabase()
+		state, err = NewAppState(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = state.aof.Sync(conf.maxmem, conf.eviction, conf.memSamples)
+		if loads := err == nil; loads != tt.loads {
+			t.Errorf("aof-load-truncated %v, tail %q: err %v", tt.loadTruncated, tt.tail, err)
+			continue
+		}
+		if !tt.loads {
+			continue
+		}
+
+		if got, want := dataset(), map[string]string{"a": "1", "b": "2"}; !maps.Equal(got, want) {
+			t.Errorf("tail %q: loaded %v, want %v", tt.tail, got, want)
+		}
+		// the partial record is cut off, so later writes follow a whole one
+		if after, err := os.Stat(fp); err != nil || after.Size() != info.Size() {
+			t.Errorf("tail %q: AOF not cut back to %d bytes: %v", tt.tail, info.Size(), err)
+		}
+	}
+}
+
+// runCheckAof runs check-aof, answering its prompt with answer.
+func runCheckAof(t *testing.T, answer string, args ...string) int {
+	t.Helper()
+
+	stdin, stdout := os.Stdin, os.Stdout
+	defer func() { os.Stdin, os.Stdout = stdin, stdout }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.WriteString(answer)
+	w.Close()
+	os.Stdin = r
+
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	os.Stdout = devnull
+
+	return checkAof(args)
+}
+
+func TestCheckAof(t *testing.T) {
+	conf := newAofConfig(t)
+	state := startAof(t, conf)
+	runCommands(t, state, []string{"SET", "a", "1"}, []string{"SET", "b", "2"})
+	manifest := path.Join(state.aof.dir, state.aof.manifestName())
+
+	if code := runCheckAof(t, "", manifest); code != 0 {
+		t.Errorf("check-aof on a valid AOF exited with %d", code)
+	}
+
+	fp := appendToAof(t, state, "")
+	info, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendToAof(t, state, "*2\r\n$3\r\nDEL\r\n$1\r\na\r\n*3\r\n$3\r\nSET\r\n$1\r")
+
+	size, valid, err := checkAofFile(fp)
+	if err == nil || size != info.Size()+36 || valid != info.Size()+20 {
+		t.Errorf("checkAofFile: size %d, valid %d, err %v", size, valid, err)
+	}
+
+	tests := []struct {
+		answer string
+		args   []string
+		code   int
+		size   int64
+	}{
+		{"", []string{fp}, 1, size},
+		{"n\n", []string{"--fix", fp}, 1, size},
+		{"y\n", []string{"--fix", manifest}, 0, valid},
+		{"", []string{fp}, 0, valid},
+	}
+	for _, tt := range tests {
+		if code := runCheckAof(t, tt.answer, tt.args...); code != tt.code {
+			t.Errorf("check-aof %v answered %q: exited with %d, want %d", tt.args, tt.answer, code, tt.code)
+		}
+		if info, err := os.Stat(fp); err != nil || info.Size() != tt.size {
+			t.Errorf("check-aof %v answered %q: AOF is %d bytes, want %d", tt.args, tt.answer, info.Size(), tt.size)
+		}
+	}
+
+	conf.aofLoadTruncated = false
+	startAof(t, conf)
+	if got, want := dataset(), map[string]string{"b": "2"}; !maps.Equal(got, want) {
+		t.Errorf("loaded %v after check-aof --fix, want %v", got, want)
+	}
+}
+
+func TestAofRewriteDue(t *testing.T) {
+	conf := newAofConfig(t)
+	state := startAof(t, conf)
+	for i := range 20 {
+		runCommands(t, state, []string{"SET", fmt.Sprint("k", i), strings.Repeat("v", 100)})
+	}
+	size := state.aof.size()
+
+	tests := []struct {
+		perc    int
+		minSize int64
+		base    int64
+		running bool
+		due     bool
+	}{
+		{100, 0, size / 2, false, true},
+		{100, 0, size/2 + 1, false, false},
+		{50, 0, size/2 + 1, false, true},
+		{0, 0, 1, false, false},
+		{100, size, 0, false, true},
+		{100, size + 1, 0, false, false},
+		{100, 0, 1, true, false},
+	}
+
+	for _, tt := range tests {
+		next := *conf
+		next.aofRewritePerc, next.aofRewriteMinSize = tt.perc, tt.minSize
+		state.config.Store(&next)
+		state.aof.baseSize.Store(tt.base)
+		state.aofRewriteRunning.Store(tt.running)
+
+		if _, _, due := aofRewriteDue(state); due != tt.due {
+			t.Errorf("%d bytes, %+v: due %v", size, tt, due)
+		}
+	}
+
+	// a rewrite starts growth from the new size
+	conf.aofRewriteMinSize = 0
+	state.config.Store(conf)
+	state.aofRewriteRunning.Store(false)
+	state.aof.baseSize.Store(1)
+	rewriteAof(t, state)
+	if _, growth, due := aofRewriteDue(state); due || growth != 0 {
+		t.Errorf("rewrite due after a rewrite, grown by %d%%", growth)
+	}
+}
+
+// encodeRecords returns cmds as AOF records.
+func encodeRecords(cmds ...[]string) string {
+	var b bytes.Buffer
+	w := NewBufferWriter(&b)
+	for _, cmd := range cmds {
+		w.Write(commandValue(cmd...))
+	}
+	return b.String()
+}
+
+func TestTruncateAofToTimestamp(t *testing.T) {
+	parts := []string{
+		timestampAnnotation(100),
+		encodeRecords([]string{"SET", "a", "1"}),
+		timestampAnnotation(200),
+		encodeRecords([]string{"SET", "b", "2"}, []string{"SET", "c", "3"}),
+		"#comment\r\n",
+		timestampAnnotation(300),
+		encodeRecords([]string{"DEL", "a"}),
+	}
+	// the offset each part starts at
+	var offsets []int64
+	var aof string
+	for _, part := range parts {
+		offsets = append(offsets, int64(len(aof)))
+		aof += part
+	}
+
+	fp := path.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(fp, []byte(aof), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ts     int64
+		offset int64
+	}{
+		{0, offsets[0]},
+		{99, offsets[0]},
+		{100, offsets[2]},
+		{250, offsets[5]},
+		{299, offsets[5]},
+		{300, -1},
+		{1000, -1},
+	}
+	for _, tt := range tests {
+		if offset, err := truncateAofToTimestamp(fp, tt.ts); err != nil || offset != tt.offset {
+			t.Errorf("truncate to %d: offset %d, err %v, want %d", tt.ts, offset, err, tt.offset)
+		}
+	}
+}
+
+func TestCheckAofTruncateToTimestamp(t *testing.T) {
+	conf := newAofConfig(t)
+	conf.aofTimestampEnabled = true
+	state := startAof(t, conf)
+
+	now := time.Now().Unix()
+	runCommands(t, state, []string{"SET", "a", "1"})
+	fp := appendToAof(t, state, timestampAnnotation(now+100)+encodeRecords([]string{"SET", "b", "2"}))
+
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("#TS:")) {
+		t.Errorf("AOF written with aof-timestamp-enabled starts %q", data)
+	}
+
+	manifest := path.Join(state.aof.dir, state.aof.manifestName())
+	if code := runCheckAof(t, "y\n", "--truncate-to-timestamp", fmt.Sprint(now+50), manifest); code != 0 {
+		t.Errorf("check-aof --truncate-to-timestamp exited with %d", code)
+	}
+
+	startAof(t, conf)
+	if got, want := dataset(), map[string]string{"a": "1"}; !maps.Equal(got, want) {
+		t.Errorf("loaded %v after truncating, want %v", got, want)
+	}
+}
+
+// syncedRecords returns how many records are known to be on disk.
+func syncedRecords(aof *Aof) int64 {
+	aof.syncMu.Lock()
+	defer aof.syncMu.Unlock()
+	return aof.synced
+}
+
+func TestAofGroupCommit(t *testing.T) {
+	conf := newAofConfig(t)
+	conf.aofFsync = Always
+	state := startAof(t, conf)
+
+	const writers, writes = 8, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := NewReplayClient(state)
+			for i := range writes {
+				set(c, commandValue("SET", fmt.Sprint("k", w, ":", i), "v"), state)
+				n := state.aof.appended.Load()
+				if err := state.aof.commit(); err != nil {
+					t.Error(err)
+					return
+				}
+				// the write is acknowledged only once its record is on disk
+				if synced := syncedRecords(state.aof); synced < n {
+					t.Errorf("commit returned with %d records synced, want at least %d", synced, n)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if synced := syncedRecords(state.aof); synced != writers*writes {
+		t.Errorf("%d records synced, want %d", synced, writers*writes)
+	}
+
+	startAof(t, conf)
+	if n := len(dataset()); n != writers*writes {
+		t.Errorf("loaded %d keys, want %d", n, writers*writes)
+	}
+}
+
+func TestAofBackgroundSync(t *testing.T) {
+	conf := newAofConfig(t)
+	state := startAof(t, conf)
+	runCommands(t, state, []string{"SET", "a", "1"}, []string{"SET", "b", "2"})
+
+	// an fsync still running when the next is due is counted as delayed
+	state.aof.syncMu.Lock()
+	state.aof.syncing = true
+	state.aof.syncMu.Unlock()
+	state.aof.backgroundSync()
+	if n := state.aof.delayedFsyncs.Load(); n != 1 {
+		t.Errorf("%d delayed fsyncs, want 1", n)
+	}
+	if synced := syncedRecords(state.aof); synced != 0 {
+		t.Errorf("%d records synced behind a running fsync", synced)
+	}
+
+	state.aof.syncMu.Lock()
+	state.aof.syncing = false
+	state.aof.syncMu.Unlock()
+	state.aof.backgroundSync()
+	for syncedRecords(state.aof) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := state.aof.delayedFsyncs.Load(); n != 1 {
+		t.Errorf("%d delayed fsyncs, want 1", n)
+	}
+}
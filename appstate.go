@@ -1,14 +1,21 @@
 package main
 
-import "time"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type RDBStats struct {
 	rdb_last_save_ts int64
 	rdb_saves        int
 }
 
+// AOFStats are updated by the rewrite goroutine while INFO reads them.
 type AOFStats struct {
-	aof_rewrites int
+	aof_rewrites              atomic.Int64
+	aof_last_bgrewrite_status atomic.Value // string
+	aof_last_rewrite_time_sec atomic.Int64
 }
 
 type GeneralStats struct {
@@ -16,18 +23,24 @@ type GeneralStats struct {
 	total_commands_processed   int
 	expired_keys               int
 	evicted_keys               int
+	// counted by whichever publisher pushed the client over its limit
+	client_output_buffer_limit_disconnections atomic.Int64
 }
 
 type AppState struct {
-	conf              *Config
+	// config is replaced as a whole by CONFIG SET, and never changed in
+	// place, so it can be read without a lock
+	config            atomic.Pointer[Config]
 	aof               *Aof
-	bgsaveRunning     bool
-	aofRewriteRunning bool
-	dbCopy            map[string]*Item
+	bgsaveRunning     atomic.Bool
+	aofRewriteRunning atomic.Bool
 	tx                *Transaction
 	monitors          []*Client
+	pubsub            *PubSub
 	serverStart       time.Time
 	clientCount       int
+	clients           map[*Client]struct{}
+	clientsMu         sync.Mutex
 	peakMem           int64
 	info              *Info
 	rdbStats          RDBStats
@@ -35,18 +48,26 @@ type AppState struct {
 	generalStats      GeneralStats
 }
 
-func NewAppState(conf *Config) *AppState {
+func NewAppState(conf *Config) (*AppState, error) {
 	state := AppState{
-		conf:         conf,
 		serverStart:  time.Now(),
 		info:         NewInfo(),
+		pubsub:       NewPubSub(),
+		clients:      map[*Client]struct{}{},
 		rdbStats:     RDBStats{},
-		aofStats:     AOFStats{},
 		generalStats: GeneralStats{},
 	}
 
+	state.config.Store(conf)
+	state.aofStats.aof_last_bgrewrite_status.Store("ok")
+	state.aofStats.aof_last_rewrite_time_sec.Store(-1)
+
 	if conf.aofEnabled {
-		state.aof = NewAof(conf)
+		aof, err := NewAof(state.conf)
+		if err != nil {
+			return nil, err
+		}
+		state.aof = aof
 
 		if conf.aofFsync == EverySec {
 			go func() {
@@ -54,11 +75,31 @@ func NewAppState(conf *Config) *AppState {
 				defer t.Stop()
 
 				for range t.C {
-					state.aof.w.Flush()
+					state.aof.backgroundSync()
 				}
 			}()
 		}
 	}
 
-	return &state
+	return &state, nil
+}
+
+// conf returns the current config. Callers that read several fields that
+// must agree should call it once.
+func (state *AppState) conf() *Config {
+	return state.config.Load()
+}
+
+func (state *AppState) addClient(c *Client) {
+	state.clientsMu.Lock()
+	state.clients[c] = struct{}{}
+	state.clientCount++
+	state.clientsMu.Unlock()
+}
+
+func (state *AppState) removeClient(c *Client) {
+	state.clientsMu.Lock()
+	delete(state.clients, c)
+	state.clientCount--
+	state.clientsMu.Unlock()
 }
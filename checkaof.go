@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// aofReader reads the records of an AOF file, keeping track of where the last
+// complete one ends, which is where a damaged file can be cut.
+type aofReader struct {
+	r          *bufio.Reader
+	src        *countingReader
+	maxBulkLen int64
+	// ts is the last timestamp annotation read, and tsOffset where it
+	// starts. Records after it were written at or after that time.
+	ts       int64
+	tsOffset int64
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func newAofReader(r io.Reader, maxBulkLen int64) *aofReader {
+	src := &countingReader{r: r}
+	return &aofReader{r: bufio.NewReader(src), src: src, maxBulkLen: maxBulkLen}
+}
+
+// next returns the next record. It returns io.EOF at a clean end of the file,
+// and io.ErrUnexpectedEOF if the file ends in the middle of a record.
+func (ar *aofReader) next() (*Value, error) {
+	b, err := ar.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	for b[0] == '#' {
+		if err := ar.readAnnotation(); err != nil {
+			return nil, err
+		}
+		if b, err = ar.r.Peek(1); err != nil {
+			return nil, err
+		}
+	}
+
+	// records are always written as arrays, never inline
+	if b[0] != '*' {
+		return nil, &ProtocolError{msg: fmt.Sprintf("expected '*', got '%c'", b[0])}
+	}
+
+	v := Value{}
+	if err := v.readArray(ar.r, ar.maxBulkLen); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if len(v.array) == 0 {
+		return nil, &ProtocolError{msg: "empty record"}
+	}
+	return &v, nil
+}
+
+// readAnnotation reads a line starting with '#'. Timestamps are kept, and
+// other annotations are skipped.
+func (ar *aofReader) readAnnotation() error {
+	offset := ar.offset()
+	line, err := readRequestLine(ar.r, PROTO_INLINE_MAX_SIZE)
+	if err == errLineTooLong {
+		return &ProtocolError{msg: "too long annotation"}
+	}
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	if ts, ok := strings.CutPrefix(line, "#TS:"); ok {
+		n, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return &ProtocolError{msg: "invalid timestamp annotation"}
+		}
+		ar.ts, ar.tsOffset = n, offset
+	}
+	return nil
+}
+
+// timestampAnnotation marks the records after it as written at ts or later.
+func timestampAnnotation(ts int64) string {
+	return fmt.Sprintf("#TS:%d\r\n", ts)
+}
+
+// offset is the number of bytes consumed by the records read so far.
+func (ar *aofReader) offset() int64 {
+	return ar.src.n - int64(ar.r.Buffered())
+}
+
+// checkAofFile scans an AOF file and returns its size and the offset just
+// past its last valid record, along with the error that stopped the scan.
+func checkAofFile(fp string) (size int64, valid int64, err error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ar := newAofReader(f, PROTO_MAX_BULK_LEN)
+	for {
+		valid = ar.offset()
+		if _, err := ar.next(); err != nil {
+			if err == io.EOF {
+				return info.Size(), valid, nil
+			}
+			return info.Size(), valid, err
+		}
+	}
+}
+
+// truncateAof cuts fp to size and fsyncs it.
+func truncateAof(fp string, size int64) error {
+	f, err := os.OpenFile(fp, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// truncateAofToTimestamp returns the offset of the first timestamp
+// annotation in fp later than ts, where the file can be cut to undo every
+// write made after ts. It returns -1 if there's none.
+func truncateAofToTimestamp(fp string, ts int64) (int64, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	ar := newAofReader(f, PROTO_MAX_BULK_LEN)
+	for {
+		_, err := ar.next()
+		if ar.ts > ts {
+			return ar.tsOffset, nil
+		}
+		if err == io.EOF {
+			return -1, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w at offset %d", err, ar.offset())
+		}
+	}
+}
+
+// checkAof implements the check-aof subcommand. It's given an AOF file, or a
+// manifest to check every file it lists, and returns the exit code. With
+// --truncate-to-timestamp it instead cuts the AOF back to how it was at a
+// given unix time, which needs aof-timestamp-enabled to have been on.
+func checkAof(args []string) int {
+	var fix bool
+	var fp string
+	truncateTo := int64(-1)
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--fix":
+			fix = true
+		case args[i] == "--truncate-to-timestamp" && i+1 < len(args):
+			ts, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || ts < 0 {
+				fmt.Println("Invalid timestamp: ", args[i+1])
+				return 1
+			}
+			truncateTo = ts
+			i++
+		case fp == "":
+			fp = args[i]
+		default:
+			fp = ""
+		}
+	}
+	if fp == "" {
+		fmt.Println("Usage: go-redis-video check-aof [--fix|--truncate-to-timestamp <unix-time>] <file.aof|file.manifest>")
+		return 1
+	}
+
+	files := []string{fp}
+	if strings.HasSuffix(fp, ".manifest") {
+		m, err := parseManifest(fp)
+		if err != nil {
+			fmt.Println("Cannot read the AOF manifest: ", err)
+			return 1
+		}
+
+		files = nil
+		for _, file := range m.files() {
+			files = append(files, path.Join(path.Dir(fp), file.name))
+		}
+	}
+
+	if truncateTo >= 0 {
+		return checkAofTruncate(files, truncateTo)
+	}
+
+	for i, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			fmt.Printf("Cannot open %s: %v\n", file, err)
+			return 1
+		}
+
+		size, valid, err := checkAofFile(file)
+		if err == nil {
+			fmt.Printf("AOF %s is valid\n", file)
+			continue
+		}
+
+		fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n", file, size, valid, size-valid)
+		fmt.Printf("%s at offset %d\n", err, valid)
+
+		// cutting any file but the last would drop the writes after it
+		if i != len(files)-1 {
+			fmt.Println("AOF is not valid, and only the last file can be fixed")
+			return 1
+		}
+		if !fix {
+			fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+			return 1
+		}
+
+		if !confirmTruncate(file, size, valid) {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func checkAofTruncate(files []string, ts int64) int {
+	for i, file := range files {
+		offset, err := truncateAofToTimestamp(file, ts)
+		if err != nil {
+			fmt.Printf("Cannot scan %s: %v\n", file, err)
+			return 1
+		}
+		if offset < 0 {
+			continue
+		}
+
+		// the files after this one were all written later still
+		if i != len(files)-1 {
+			fmt.Printf("Writes after %d start in %s, and only the last file can be truncated\n", ts, file)
+			return 1
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			fmt.Printf("Cannot open %s: %v\n", file, err)
+			return 1
+		}
+		if !confirmTruncate(file, info.Size(), offset) {
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Printf("AOF has no writes after %d, nothing to truncate\n", ts)
+	return 0
+}
+
+// confirmTruncate asks before cutting file from size to valid bytes, and
+// reports whether it was cut.
+func confirmTruncate(file string, size int64, valid int64) bool {
+	fmt.Printf("This will shrink the AOF %s from %d bytes, with %d bytes, to %d bytes\n", file, size, size-valid, valid)
+	fmt.Print("Continue? [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+		fmt.Println("Aborting...")
+		return false
+	}
+
+	if err := truncateAof(file, valid); err != nil {
+		fmt.Println("Failed to truncate AOF: ", err)
+		return false
+	}
+	fmt.Printf("Successfully truncated AOF %s\n", file)
+	return true
+}
+
+// errAofTruncated is returned when the AOF ends mid-record and
+// aof-load-truncated is off.
+var errAofTruncated = errors.New("AOF is truncated, use check-aof --fix or set aof-load-truncated yes")
@@ -1,19 +1,230 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var nextClientID atomic.Int64
+
+// output buffers that grew past this are dropped after being written, rather
+// than keeping their capacity for the life of the connection
+const outputBufferKeep = 1024 * 1024
+
+// output is written in chunks of clientWriteChunk, and a client that takes
+// none of a chunk within clientWriteTimeout is disconnected, so writeLoop
+// can't block forever on a peer that stopped reading
+const clientWriteChunk = 64 * 1024
+
+var clientWriteTimeout = 30 * time.Second
+
 type Client struct {
+	id            int64
 	conn          net.Conn
+	state         *AppState
 	authenticated bool
+	// replay is set on the client that runs AOF records at startup
+	replay bool
+	user   string
+	name   string
+	proto  int
+	subs   map[string]struct{}
+	psubs  map[string]struct{}
+	ssubs  map[string]struct{}
+
+	// replies and pub/sub messages are encoded into out and written by
+	// writeLoop, so that publishers never wait on a slow connection
+	mu             sync.Mutex
+	out            *bytes.Buffer
+	enc            *Writer
+	inflight       int // bytes writeLoop is writing right now
+	softLimitSince time.Time
+	closing        bool
+	ready          chan struct{}
+	closed         chan struct{}
+}
+
+func NewClient(conn net.Conn, state *AppState) *Client {
+	out := &bytes.Buffer{}
+
+	return &Client{
+		id:     nextClientID.Add(1),
+		conn:   conn,
+		state:  state,
+		user:   "default",
+		proto:  2,
+		subs:   map[string]struct{}{},
+		psubs:  map[string]struct{}{},
+		ssubs:  map[string]struct{}{},
+		out:    out,
+		enc:    NewBufferWriter(out),
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// NewReplayClient returns a client with no connection, used to run commands
+// read back from the AOF. Its replies are discarded.
+func NewReplayClient(state *AppState) *Client {
+	out := &bytes.Buffer{}
+
+	return &Client{
+		id:            nextClientID.Add(1),
+		state:         state,
+		user:          "default",
+		authenticated: true,
+		replay:        true,
+		proto:         2,
+		subs:          map[string]struct{}{},
+		psubs:         map[string]struct{}{},
+		ssubs:         map[string]struct{}{},
+		out:           out,
+		enc:           NewBufferWriter(out),
+	}
+}
+
+// send queues v and wakes writeLoop. It never blocks.
+func (c *Client) send(v *Value) {
+	c.queue(v)
+	c.flush()
+}
+
+// queue encodes v into the output buffer, to be written on the next flush.
+// Clients whose buffer breaks the output buffer limits are disconnected.
+func (c *Client) queue(v *Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing || c.replay {
+		return
+	}
+
+	c.enc.proto = c.proto
+	c.enc.Write(v)
+
+	c.checkOutputLimits()
+}
+
+// flush wakes writeLoop to write everything queued so far.
+func (c *Client) flush() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// outputClass picks the client-output-buffer-limit class for the client.
+// There's no replication yet, so no client is in the replica class.
+func (c *Client) outputClass() string {
+	if c.subscribed() {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// checkOutputLimits disconnects the client if its pending output is over the
+// hard limit, or has been over the soft limit for too long. The caller must
+// hold c.mu.
+func (c *Client) checkOutputLimits() {
+	limit := c.state.conf().outputLimits[c.outputClass()]
+	used := int64(c.out.Len() + c.inflight)
+
+	over := limit.hard > 0 && used >= limit.hard
+	if limit.soft > 0 && used >= limit.soft {
+		if c.softLimitSince.IsZero() {
+			c.softLimitSince = time.Now()
+		}
+		if time.Since(c.softLimitSince) >= limit.softSecs {
+			over = true
+		}
+	} else {
+		c.softLimitSince = time.Time{}
+	}
+
+	if !over {
+		return
+	}
+
+	log.Printf("client %d scheduled to be closed for overcoming of output buffer limits (%s, %d bytes)", c.id, c.outputClass(), used)
+	c.state.generalStats.client_output_buffer_limit_disconnections.Add(1)
+
+	c.closing = true
+	c.out.Reset()
+	// unblocks both writeLoop and the read loop
+	c.conn.Close()
+}
+
+// writeLoop writes the output buffer until the client is closed, then writes
+// whatever is left and closes the connection.
+func (c *Client) writeLoop() {
+	spare := &bytes.Buffer{}
+
+	for {
+		var done bool
+		select {
+		case <-c.closed:
+			done = true
+		case <-c.ready:
+		}
+
+		c.mu.Lock()
+		pending := c.out
+		c.out = spare
+		c.enc.writer = spare
+		c.inflight = pending.Len()
+		c.mu.Unlock()
+
+		err := c.write(pending.Bytes())
+
+		c.mu.Lock()
+		c.inflight = 0
+		c.mu.Unlock()
+
+		// closing the connection also stops the read loop
+		if err != nil {
+			log.Println("error writing to client: ", err)
+			c.conn.Close()
+			return
+		}
+
+		spare = pending
+		spare.Reset()
+		if spare.Cap() > outputBufferKeep {
+			spare = &bytes.Buffer{}
+		}
+
+		if done {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+func (c *Client) write(b []byte) error {
+	for len(b) > 0 {
+		n := min(len(b), clientWriteChunk)
+		c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		if _, err := c.conn.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// subscriptions counts classic channels and patterns. Shard channels are
+// counted separately, as in Redis.
+func (c *Client) subscriptions() int {
+	return len(c.subs) + len(c.psubs)
 }
 
-func NewClient(conn net.Conn) *Client {
-	return &Client{conn: conn}
+func (c *Client) subscribed() bool {
+	return c.subscriptions()+len(c.ssubs) > 0
 }
 
 func (c *Client) writeMonitorLog(v *Value) {
@@ -24,8 +235,5 @@ func (c *Client) writeMonitorLog(v *Value) {
 		msg += fmt.Sprintf("\"%s\"", v.bulk)
 	}
 
-	reply := Value{typ: STRING, str: msg}
-	w := NewWriter(c.conn)
-	w.Write(&reply)
-	w.Flush()
+	c.send(&Value{typ: STRING, str: msg})
 }
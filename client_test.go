@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutputLimitDisconnects(t *testing.T) {
+	state := newTestState(t)
+	conf := NewConfig()
+	conf.outputLimits["pubsub"] = OutputLimit{hard: 1024}
+	state.config.Store(conf)
+
+	var clients []*Client
+	for range 4 {
+		server, client := net.Pipe()
+		defer client.Close()
+		c := NewClient(server, state)
+		state.pubsub.subscribe(c, []string{"ch"}, false)
+		clients = append(clients, c)
+	}
+
+	// publishers push subscribers over the limit concurrently
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state.pubsub.publish("ch", strings.Repeat("x", 2048))
+		}()
+	}
+	wg.Wait()
+
+	for _, c := range clients {
+		if !c.closing {
+			t.Errorf("client %d over the hard limit wasn't closed", c.id)
+		}
+	}
+	if n := state.generalStats.client_output_buffer_limit_disconnections.Load(); n != int64(len(clients)) {
+		t.Errorf("%d disconnections counted, want %d", n, len(clients))
+	}
+}
+
+func TestWriteLoopPeerNotReading(t *testing.T) {
+	timeout := clientWriteTimeout
+	clientWriteTimeout = 50 * time.Millisecond
+	defer func() { clientWriteTimeout = timeout }()
+
+	state := newTestState(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	c := NewClient(server, state)
+
+	done := make(chan struct{})
+	go func() {
+		c.writeLoop()
+		close(done)
+	}()
+
+	// the peer never reads the reply, and the connection is closed
+	c.send(&Value{typ: BULK, bulk: strings.Repeat("x", 1024)})
+	close(c.closed)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writeLoop still blocked on a peer that stopped reading")
+	}
+}
@@ -2,32 +2,91 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	config_fp   string
-	dir         string
-	rdb         []RDBSnapshot
-	rdbFn       string
-	aofEnabled  bool
-	aofFn       string
+	config_fp  string
+	dir        string
+	rdb        []RDBSnapshot
+	rdbFn      string
+	aofEnabled bool
+	aofFn      string
+	aofDirname string
+	// aofLoadTruncated loads an AOF cut short by a crash, instead of
+	// refusing to start
+	aofLoadTruncated bool
+	// the AOF is rewritten once it grows by aofRewritePerc percent over its
+	// size after the last rewrite, and is at least aofRewriteMinSize
+	aofRewritePerc    int
+	aofRewriteMinSize int64
+	// aofTimestampEnabled annotates the AOF with the time of its writes
+	aofTimestampEnabled bool
+	// rdbChecksum writes a checksum into RDB files and verifies it on load
+	rdbChecksum bool
 	aofFsync    FSyncMode
 	requirepass bool
 	password    string
 	maxmem      int64
 	eviction    Eviction
 	memSamples  int
+	notifyFlags NotifyFlags
+	// protoMaxBulkLen limits the size of a single bulk string in a request
+	protoMaxBulkLen int64
+	outputLimits    map[string]OutputLimit
+	bind            []string
+	port            int
+	unixsocket      string
+	unixsocketperm  os.FileMode
+	tlsPort         int
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsCACertFile   string
+	tlsAuthClients  TLSAuthClients
+	// tlsAuthClientsUser is "CN" to authenticate clients as the common name
+	// of their certificate, or "off"
+	tlsAuthClientsUser string
 }
 
 func NewConfig() *Config {
-	return &Config{}
+	return &Config{
+		protoMaxBulkLen:    PROTO_MAX_BULK_LEN,
+		aofFn:              "appendonly.aof",
+		aofDirname:         "appendonlydir",
+		aofLoadTruncated:   true,
+		rdbChecksum:        true,
+		aofRewritePerc:     100,
+		aofRewriteMinSize:  64 * 1024 * 1024,
+		port:               6379,
+		tlsAuthClients:     TLSAuthYes,
+		tlsAuthClientsUser: "off",
+		outputLimits: map[string]OutputLimit{
+			"normal":  {},
+			"replica": {hard: 256 * 1024 * 1024, soft: 64 * 1024 * 1024, softSecs: 60 * time.Second},
+			"pubsub":  {hard: 32 * 1024 * 1024, soft: 8 * 1024 * 1024, softSecs: 60 * time.Second},
+		},
+	}
+}
+
+// OutputLimit bounds a client's pending output. Going over hard disconnects
+// it at once, while staying over soft for softSecs does so eventually. Zero
+// disables a limit.
+type OutputLimit struct {
+	hard     int64
+	soft     int64
+	softSecs time.Duration
 }
 
+var outputLimitClasses = []string{"normal", "replica", "pubsub"}
+
 type RDBSnapshot struct {
 	Secs        int
 	KeysChanged int
@@ -70,7 +129,9 @@ func readConf(fn string) *Config {
 
 	for s.Scan() {
 		l := s.Text()
-		parseLine(l, conf)
+		if err := parseLine(l, conf); err != nil {
+			fmt.Println("error parsing config line: ", err)
+		}
 	}
 
 	if err := s.Err(); err != nil {
@@ -85,7 +146,7 @@ func readConf(fn string) *Config {
 	return conf
 }
 
-func parseLine(l string, conf *Config) {
+func parseLine(l string, conf *Config) error {
 	args := strings.Split(l, " ")
 	cmd := args[0]
 
@@ -94,13 +155,13 @@ func parseLine(l string, conf *Config) {
 		secs, err := strconv.Atoi(args[1])
 		if err != nil {
 			fmt.Println("invalid secs")
-			return
+			return err
 		}
 
 		keysChanged, err := strconv.Atoi(args[2])
 		if err != nil {
 			fmt.Println("invalid keys")
-			return
+			return err
 		}
 
 		snapshot := RDBSnapshot{
@@ -110,8 +171,41 @@ func parseLine(l string, conf *Config) {
 		conf.rdb = append(conf.rdb, snapshot)
 	case "dbfilename":
 		conf.rdbFn = args[1]
+	case "rdbchecksum":
+		if args[1] != "yes" && args[1] != "no" {
+			return errors.New("rdbchecksum must be yes or no")
+		}
+		conf.rdbChecksum = args[1] == "yes"
 	case "appendfilename":
 		conf.aofFn = args[1]
+	case "appenddirname":
+		// a path would let the AOF escape dir
+		if args[1] != path.Base(args[1]) {
+			return errors.New("appenddirname can't be a path, just a directory name")
+		}
+		conf.aofDirname = args[1]
+	case "aof-load-truncated":
+		if args[1] != "yes" && args[1] != "no" {
+			return errors.New("aof-load-truncated must be yes or no")
+		}
+		conf.aofLoadTruncated = args[1] == "yes"
+	case "auto-aof-rewrite-percentage":
+		perc, err := strconv.Atoi(args[1])
+		if err != nil || perc < 0 {
+			return errors.New("invalid auto-aof-rewrite-percentage")
+		}
+		conf.aofRewritePerc = perc
+	case "auto-aof-rewrite-min-size":
+		size, err := parseMem(args[1])
+		if err != nil {
+			return err
+		}
+		conf.aofRewriteMinSize = size
+	case "aof-timestamp-enabled":
+		if args[1] != "yes" && args[1] != "no" {
+			return errors.New("aof-timestamp-enabled must be yes or no")
+		}
+		conf.aofTimestampEnabled = args[1] == "yes"
 	case "appendfsync":
 		conf.aofFsync = FSyncMode(args[1])
 	case "dir":
@@ -123,14 +217,14 @@ func parseLine(l string, conf *Config) {
 			conf.aofEnabled = false
 		}
 	case "requirepass":
-		conf.requirepass = true
+		conf.requirepass = args[1] != ""
 		conf.password = args[1]
 	case "maxmemory":
 		maxmem, err := parseMem(args[1])
 		if err != nil {
 			log.Println("cannot parse maxmemory. defaulting to 0. error: ", err)
 			conf.maxmem = 0
-			break
+			return err
 		}
 		conf.maxmem = maxmem
 	case "maxmemory-policy":
@@ -140,10 +234,185 @@ func parseLine(l string, conf *Config) {
 		if err != nil {
 			log.Println("cannot parse maxmemory-samples. defaulting to 50. error: ", err)
 			conf.memSamples = 50
-			break
+			return err
 		}
 		conf.memSamples = memSamples
+	case "notify-keyspace-events":
+		flags, err := parseNotifyFlags(strings.Trim(strings.Join(args[1:], ""), "\""))
+		if err != nil {
+			return err
+		}
+		conf.notifyFlags = flags
+	case "proto-max-bulk-len":
+		n, err := parseMem(args[1])
+		if err != nil {
+			return err
+		}
+		if n < 1024*1024 {
+			return errors.New("proto-max-bulk-len must be at least 1mb")
+		}
+		conf.protoMaxBulkLen = n
+	case "client-output-buffer-limit":
+		if len(args) < 5 || (len(args)-1)%4 != 0 {
+			return errors.New("wrong number of arguments")
+		}
+
+		// build a new map, since CONFIG SET works on a shallow copy
+		limits := map[string]OutputLimit{}
+		maps.Copy(limits, conf.outputLimits)
+
+		for i := 1; i < len(args); i += 4 {
+			class := args[i]
+			if class == "slave" {
+				class = "replica"
+			}
+			if !contains(outputLimitClasses, class) {
+				return fmt.Errorf("invalid client class '%s'", args[i])
+			}
+
+			hard, err := parseMem(args[i+1])
+			if err != nil {
+				return err
+			}
+			soft, err := parseMem(args[i+2])
+			if err != nil {
+				return err
+			}
+			secs, err := strconv.Atoi(args[i+3])
+			if err != nil || secs < 0 {
+				return errors.New("invalid soft limit seconds")
+			}
+
+			limits[class] = OutputLimit{hard: hard, soft: soft, softSecs: time.Duration(secs) * time.Second}
+		}
+		conf.outputLimits = limits
+	case "bind":
+		conf.bind = nil
+		for _, addr := range args[1:] {
+			if addr != "" {
+				conf.bind = append(conf.bind, addr)
+			}
+		}
+	case "port":
+		port, err := strconv.Atoi(args[1])
+		if err != nil || port < 0 || port > 65535 {
+			return errors.New("invalid port")
+		}
+		conf.port = port
+	case "unixsocket":
+		conf.unixsocket = args[1]
+	case "unixsocketperm":
+		perm, err := strconv.ParseUint(args[1], 8, 32)
+		if err != nil || perm > 0777 {
+			return errors.New("invalid socket file permissions")
+		}
+		conf.unixsocketperm = os.FileMode(perm)
+	case "tls-port":
+		port, err := strconv.Atoi(args[1])
+		if err != nil || port < 0 || port > 65535 {
+			return errors.New("invalid port")
+		}
+		conf.tlsPort = port
+	case "tls-cert-file":
+		conf.tlsCertFile = args[1]
+	case "tls-key-file":
+		conf.tlsKeyFile = args[1]
+	case "tls-ca-cert-file":
+		conf.tlsCACertFile = args[1]
+	case "tls-auth-clients":
+		mode := TLSAuthClients(args[1])
+		if mode != TLSAuthYes && mode != TLSAuthNo && mode != TLSAuthOptional {
+			return errors.New("tls-auth-clients must be yes, no or optional")
+		}
+		conf.tlsAuthClients = mode
+	case "tls-auth-clients-user":
+		if args[1] != "CN" && args[1] != "off" {
+			return errors.New("tls-auth-clients-user must be CN or off")
+		}
+		conf.tlsAuthClientsUser = args[1]
 	}
+
+	return nil
+}
+
+// configParams maps each directive CONFIG GET can report to its current value.
+var configParams = map[string]func(*Config) string{
+	"dir":        func(c *Config) string { return c.dir },
+	"dbfilename": func(c *Config) string { return c.rdbFn },
+	"rdbchecksum": func(c *Config) string {
+		if c.rdbChecksum {
+			return "yes"
+		}
+		return "no"
+	},
+	"appendfilename":              func(c *Config) string { return c.aofFn },
+	"appenddirname":               func(c *Config) string { return c.aofDirname },
+	"auto-aof-rewrite-percentage": func(c *Config) string { return fmt.Sprint(c.aofRewritePerc) },
+	"auto-aof-rewrite-min-size":   func(c *Config) string { return fmt.Sprint(c.aofRewriteMinSize) },
+	"aof-timestamp-enabled": func(c *Config) string {
+		if c.aofTimestampEnabled {
+			return "yes"
+		}
+		return "no"
+	},
+	"aof-load-truncated": func(c *Config) string {
+		if c.aofLoadTruncated {
+			return "yes"
+		}
+		return "no"
+	},
+	"appendfsync": func(c *Config) string { return string(c.aofFsync) },
+	"appendonly": func(c *Config) string {
+		if c.aofEnabled {
+			return "yes"
+		}
+		return "no"
+	},
+	"save": func(c *Config) string {
+		var parts []string
+		for _, rdb := range c.rdb {
+			parts = append(parts, fmt.Sprintf("%d %d", rdb.Secs, rdb.KeysChanged))
+		}
+		return strings.Join(parts, " ")
+	},
+	"requirepass":            func(c *Config) string { return c.password },
+	"maxmemory":              func(c *Config) string { return fmt.Sprint(c.maxmem) },
+	"maxmemory-policy":       func(c *Config) string { return string(c.eviction) },
+	"maxmemory-samples":      func(c *Config) string { return fmt.Sprint(c.memSamples) },
+	"notify-keyspace-events": func(c *Config) string { return c.notifyFlags.String() },
+	"proto-max-bulk-len":     func(c *Config) string { return fmt.Sprint(c.protoMaxBulkLen) },
+	"bind":                   func(c *Config) string { return strings.Join(c.bind, " ") },
+	"port":                   func(c *Config) string { return fmt.Sprint(c.port) },
+	"unixsocket":             func(c *Config) string { return c.unixsocket },
+	"unixsocketperm":         func(c *Config) string { return fmt.Sprintf("%o", c.unixsocketperm) },
+	"tls-port":               func(c *Config) string { return fmt.Sprint(c.tlsPort) },
+	"tls-cert-file":          func(c *Config) string { return c.tlsCertFile },
+	"tls-key-file":           func(c *Config) string { return c.tlsKeyFile },
+	"tls-ca-cert-file":       func(c *Config) string { return c.tlsCACertFile },
+	"tls-auth-clients":       func(c *Config) string { return string(c.tlsAuthClients) },
+	"tls-auth-clients-user":  func(c *Config) string { return c.tlsAuthClientsUser },
+	"client-output-buffer-limit": func(c *Config) string {
+		var parts []string
+		for _, class := range outputLimitClasses {
+			l := c.outputLimits[class]
+			parts = append(parts, fmt.Sprintf("%s %d %d %d", class, l.hard, l.soft, int(l.softSecs.Seconds())))
+		}
+		return strings.Join(parts, " ")
+	},
+}
+
+// configMutable lists the directives CONFIG SET can change at runtime.
+var configMutable = []string{
+	"requirepass",
+	"maxmemory",
+	"maxmemory-policy",
+	"maxmemory-samples",
+	"notify-keyspace-events",
+	"proto-max-bulk-len",
+	"client-output-buffer-limit",
+	"auto-aof-rewrite-percentage",
+	"auto-aof-rewrite-min-size",
+	"aof-timestamp-enabled",
 }
 
 func parseMem(s string) (int64, error) {
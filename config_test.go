@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConfigSetWhileServing(t *testing.T) {
+	state := newTestState(t)
+	c := NewReplayClient(state)
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				if w%2 == 0 {
+					config(c, commandValue("CONFIG", "SET", "maxmemory", fmt.Sprint(1<<30+i), "maxmemory-samples", fmt.Sprint(i+1)), state)
+				} else {
+					set(c, commandValue("SET", fmt.Sprint("k", i), "v"), state)
+					config(c, commandValue("CONFIG", "GET", "maxmemory"), state)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := state.conf().maxmem; got != 1<<30+199 {
+		t.Errorf("maxmemory = %d after the last CONFIG SET", got)
+	}
+}
+
+func TestConfigSetKeepsConfigOnError(t *testing.T) {
+	state := newTestState(t)
+	c := NewReplayClient(state)
+	before := state.conf()
+
+	reply := config(c, commandValue("CONFIG", "SET", "maxmemory", "10mb", "maxmemory-samples", "lots"), state)
+	if reply.typ != ERROR {
+		t.Fatalf("CONFIG SET replied %+v", reply)
+	}
+	if state.conf() != before || before.maxmem != 0 {
+		t.Error("a failed CONFIG SET changed the config")
+	}
+}
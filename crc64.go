@@ -0,0 +1,29 @@
+package main
+
+// crc64 implements the Jones polynomial CRC-64 used by Redis for DUMP
+// payloads and RDB files. hash/crc64 can't be used because it inverts the
+// checksum on input and output, which Redis doesn't.
+var crc64Table = func() [256]uint64 {
+	const poly = 0x95ac9329ac4bc9b5 // 0xad93d23594c935a9 reflected
+
+	var table [256]uint64
+	for i := range 256 {
+		crc := uint64(i)
+		for range 8 {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
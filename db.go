@@ -12,24 +12,34 @@ type Database struct {
 	store map[string]*Item
 	mu    sync.RWMutex
 	mem   int64
+	// gen counts the times store was replaced, so snapshots of an old one
+	// stop tracking writes
+	gen       uint64
+	snapshots []*Snapshot
+	snapMu    sync.Mutex
+	// expires holds the keys with a TTL, which the active expire cycle
+	// samples
+	expires map[string]struct{}
 }
 
 func NewDatabase() *Database {
 	return &Database{
-		store: map[string]*Item{},
-		mu:    sync.RWMutex{},
+		store:   map[string]*Item{},
+		mu:      sync.RWMutex{},
+		expires: map[string]struct{}{},
 	}
 }
 
 func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
-	if state.conf.eviction == NoEviction {
+	conf := state.conf()
+	if conf.eviction == NoEviction {
 		return errors.New("maximum memory reached")
 	}
 
 	samples := sampleKeys(state)
 
 	enoughMemFreed := func() bool {
-		if db.mem+requiredMem < state.conf.maxmem {
+		if db.mem+requiredMem < conf.maxmem {
 			return true
 		} else {
 			return false
@@ -40,7 +50,9 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 		var n int
 		for _, s := range samples {
 			log.Println("evicting ", s.k)
-			db.Delete(s.k)
+			db.remove(s.k)
+			notifyKeyspaceEvent(state, NotifyEvicted, "evicted", s.k)
+			propagate(state, "DEL", s.k)
 			n++
 			if enoughMemFreed() {
 				break
@@ -49,7 +61,7 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 		return n
 	}
 
-	switch state.conf.eviction {
+	switch conf.eviction {
 	case AllKeysRandom:
 		evictedKeys := evictUntilMemFreed(samples)
 		state.generalStats.evicted_keys += evictedKeys
@@ -74,30 +86,105 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 	return nil
 }
 
+// tryExpire removes the key if it has expired. The caller must hold the write
+// lock.
 func (db *Database) tryExpire(k string, i *Item, state *AppState) bool {
 	if i.shouldExpire() {
-		DB.mu.Lock()
-		DB.Delete(k)
-		DB.mu.Unlock()
+		db.remove(k)
+		notifyKeyspaceEvent(state, NotifyExpired, "expired", k)
+		// the AOF records the removal, so a replay doesn't depend on the clock
+		propagate(state, "DEL", k)
 		state.generalStats.expired_keys++
 		return true
 	}
 	return false
 }
 
+// trackExpiry records whether k has a TTL, whenever its item is stored or
+// its expiry changes. The caller must hold the write lock.
+func (db *Database) trackExpiry(k string, item *Item) {
+	if item.Exp.Unix() != UNIX_TS_EPOCH {
+		db.expires[k] = struct{}{}
+	} else {
+		delete(db.expires, k)
+	}
+}
+
+const (
+	activeExpireInterval = 100 * time.Millisecond
+	// each round checks activeExpireSamples keys with a TTL, and another
+	// follows while more than activeExpireRepeat percent of them had expired
+	activeExpireSamples = 20
+	activeExpireRepeat  = 25
+	// activeExpireBudget bounds how long a cycle goes on for
+	activeExpireBudget = 25 * time.Millisecond
+)
+
+// InitActiveExpire starts removing expired keys in the background, so keys
+// nothing reads still expire and publish their "expired" events.
+func InitActiveExpire(state *AppState) {
+	go func() {
+		t := time.NewTicker(activeExpireInterval)
+		defer t.Stop()
+
+		for range t.C {
+			DB.activeExpireCycle(state)
+		}
+	}()
+}
+
+// activeExpireCycle samples keys with a TTL and removes the expired ones, as
+// Redis does, and returns how many it removed. The write lock is only held
+// for a round at a time.
+func (db *Database) activeExpireCycle(state *AppState) int {
+	start := time.Now()
+
+	var removed int
+	for {
+		var sampled, expired int
+
+		db.mu.Lock()
+		for k := range db.expires {
+			if sampled == activeExpireSamples {
+				break
+			}
+			sampled++
+
+			item, ok := db.store[k]
+			if !ok {
+				delete(db.expires, k)
+				continue
+			}
+			if db.tryExpire(k, item, state) {
+				expired++
+			}
+		}
+		db.mu.Unlock()
+
+		removed += expired
+		if sampled == 0 || expired*100 <= sampled*activeExpireRepeat || time.Since(start) > activeExpireBudget {
+			return removed
+		}
+	}
+}
+
 func (db *Database) Get(k string, state *AppState) (i *Item, ok bool) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+	// a write lock, since reads update access stats and may expire the key
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
 	item, ok := db.store[k]
 	if !ok {
+		notifyKeyspaceEvent(state, NotifyKeyMiss, "keymiss", k)
 		return item, ok
 	}
 	expired := db.tryExpire(k, item, state)
 	if expired {
+		notifyKeyspaceEvent(state, NotifyKeyMiss, "keymiss", k)
 		return &Item{}, false
 	}
 
+	db.beforeWrite(k)
 	item.Accesses++
 	item.LastAccess = time.Now()
 
@@ -105,16 +192,38 @@ func (db *Database) Get(k string, state *AppState) (i *Item, ok bool) {
 	return item, ok
 }
 
+// Peek returns an item without updating its access stats. Expired items are
+// reported as missing but left for the next Get to remove. The caller must
+// hold at least a read lock.
+func (db *Database) Peek(k string) (*Item, bool) {
+	item, ok := db.store[k]
+	if !ok || item.shouldExpire() {
+		return nil, false
+	}
+	return item, true
+}
+
 func (db *Database) Set(k string, v string, state *AppState) error {
-	if old, ok := db.store[k]; ok {
+	if err := db.SetItem(k, &Item{V: v}, state); err != nil {
+		return err
+	}
+
+	notifyKeyspaceEvent(state, NotifyString, "set", k)
+	return nil
+}
+
+// SetItem stores a fully built item, keeping its expiry and access stats.
+func (db *Database) SetItem(k string, key *Item, state *AppState) error {
+	old, exists := db.store[k]
+	if exists {
 		oldmem := old.approxMemUsage(k)
 		db.mem -= oldmem
 	}
 
-	key := &Item{V: v}
 	kmem := key.approxMemUsage(k)
 
-	outOfMem := state.conf.maxmem > 0 && db.mem+kmem >= state.conf.maxmem
+	maxmem := state.conf().maxmem
+	outOfMem := maxmem > 0 && db.mem+kmem >= maxmem
 	if outOfMem {
 		err := db.evictKeys(state, kmem)
 		if err != nil {
@@ -122,7 +231,9 @@ func (db *Database) Set(k string, v string, state *AppState) error {
 		}
 	}
 
+	db.beforeWrite(k)
 	db.store[k] = key
+	db.trackExpiry(k, key)
 	db.mem += kmem
 	log.Println("memory: ", db.mem)
 
@@ -130,19 +241,37 @@ func (db *Database) Set(k string, v string, state *AppState) error {
 		state.peakMem = db.mem
 	}
 
+	if !exists {
+		notifyKeyspaceEvent(state, NotifyNew, "new", k)
+	}
+
 	return nil
 }
 
-func (db *Database) Delete(k string) {
+// Delete removes a key on behalf of a client and reports whether it existed.
+func (db *Database) Delete(k string, state *AppState) bool {
+	if !db.remove(k) {
+		return false
+	}
+
+	notifyKeyspaceEvent(state, NotifyGeneric, "del", k)
+	return true
+}
+
+func (db *Database) remove(k string) bool {
 	key, ok := db.store[k]
 	if !ok {
-		return // fail gracefully
+		return false // fail gracefully
 	}
 	kmem := key.approxMemUsage(k)
 
+	db.beforeWrite(k)
 	delete(db.store, k)
+	delete(db.expires, k)
 	db.mem -= kmem
 	log.Println("memory: ", db.mem)
+
+	return true
 }
 
 var DB = NewDatabase()
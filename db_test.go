@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActiveExpire(t *testing.T) {
+	state := newTestState(t)
+	conf := NewConfig()
+	conf.notifyFlags, _ = parseNotifyFlags("Ex")
+	state.config.Store(conf)
+	c := NewReplayClient(state)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	sub := NewClient(server, state)
+	state.pubsub.subscribe(sub, []string{"__keyevent@0__:expired"}, false)
+
+	past := fmt.Sprint(time.Now().Add(-time.Second).UnixMilli())
+	for i := range 100 {
+		set(c, commandValue("SET", fmt.Sprint("gone", i), "v"), state)
+		pexpireat(c, commandValue("PEXPIREAT", fmt.Sprint("gone", i), past), state)
+	}
+	set(c, commandValue("SET", "later", "v"), state)
+	expire(c, commandValue("EXPIRE", "later", "100"), state)
+	set(c, commandValue("SET", "kept", "v"), state)
+	// overwriting a key clears its TTL
+	set(c, commandValue("SET", "overwritten", "v"), state)
+	pexpireat(c, commandValue("PEXPIREAT", "overwritten", past), state)
+	set(c, commandValue("SET", "overwritten", "v"), state)
+
+	if n := DB.activeExpireCycle(state); n != 100 {
+		t.Errorf("expired %d keys, want 100", n)
+	}
+
+	DB.mu.RLock()
+	keys := slices.Sorted(maps.Keys(DB.store))
+	expires := slices.Sorted(maps.Keys(DB.expires))
+	DB.mu.RUnlock()
+	if want := []string{"kept", "later", "overwritten"}; !slices.Equal(keys, want) {
+		t.Errorf("keys %v left, want %v", keys, want)
+	}
+	if want := []string{"later"}; !slices.Equal(expires, want) {
+		t.Errorf("keys %v have a TTL, want %v", expires, want)
+	}
+
+	// every key was expired without being read, and published its event
+	sub.mu.Lock()
+	events := strings.Count(sub.out.String(), "$7\r\nmessage\r\n")
+	sub.mu.Unlock()
+	if events != 100 {
+		t.Errorf("%d expired events published, want 100", events)
+	}
+	if n := state.generalStats.expired_keys; n != 100 {
+		t.Errorf("expired_keys is %d, want 100", n)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	dumpTypeString byte   = 0
+	dumpVersion    uint16 = 1
+)
+
+var errBadPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// A DUMP payload is laid out as:
+//
+//	type (1 byte) | value (length-prefixed) | ttl in ms, 0 if none (8 bytes)
+//	| version (2 bytes) | crc64 of everything before it (8 bytes)
+//
+// Fixed-width integers are little endian. Lengths use the RDB length
+// encoding so the value section can be shared with RDB files.
+type dumpPayload struct {
+	typ byte
+	val string
+	ttl int64
+}
+
+func dumpItem(item *Item) []byte {
+	var ttl int64
+	if item.Exp.Unix() != UNIX_TS_EPOCH {
+		ttl = max(time.Until(item.Exp).Milliseconds(), 1)
+	}
+
+	b := []byte{dumpTypeString}
+	b = appendLen(b, uint64(len(item.V)))
+	b = append(b, item.V...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(ttl))
+	b = binary.LittleEndian.AppendUint16(b, dumpVersion)
+	b = binary.LittleEndian.AppendUint64(b, crc64(0, b))
+
+	return b
+}
+
+func parseDump(b []byte) (*dumpPayload, error) {
+	// type, one length byte, ttl, version and checksum
+	if len(b) < 1+1+8+2+8 {
+		return nil, errBadPayload
+	}
+
+	footer := len(b) - 10
+	version := binary.LittleEndian.Uint16(b[footer:])
+	sum := binary.LittleEndian.Uint64(b[footer+2:])
+	if version > dumpVersion || crc64(0, b[:footer+2]) != sum {
+		return nil, errBadPayload
+	}
+
+	p := dumpPayload{typ: b[0]}
+	if p.typ != dumpTypeString {
+		return nil, errors.New("Bad data format")
+	}
+
+	n, size, err := readLen(b[1:footer])
+	if err != nil {
+		return nil, err
+	}
+
+	start := 1 + size
+	if footer-start < 8 || n != uint64(footer-start-8) {
+		return nil, errors.New("Bad data format")
+	}
+
+	p.val = string(b[start : start+int(n)])
+	p.ttl = int64(binary.LittleEndian.Uint64(b[start+int(n):]))
+
+	return &p, nil
+}
+
+// appendLen writes n with the RDB length encoding: 6 bits, 14 bits, or a
+// marker byte followed by a big endian 32 or 64 bit integer.
+func appendLen(b []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, byte(n>>8)|0x40, byte(n))
+	case n <= 0xffffffff:
+		b = append(b, 0x80)
+		return binary.BigEndian.AppendUint32(b, uint32(n))
+	default:
+		b = append(b, 0x81)
+		return binary.BigEndian.AppendUint64(b, n)
+	}
+}
+
+func readLen(b []byte) (n uint64, size int, err error) {
+	errShort := errors.New("Bad data format")
+	if len(b) < 1 {
+		return 0, 0, errShort
+	}
+
+	switch b[0] >> 6 {
+	case 0:
+		return uint64(b[0] & 0x3f), 1, nil
+	case 1:
+		if len(b) < 2 {
+			return 0, 0, errShort
+		}
+		return uint64(b[0]&0x3f)<<8 | uint64(b[1]), 2, nil
+	}
+
+	switch b[0] {
+	case 0x80:
+		if len(b) < 5 {
+			return 0, 0, errShort
+		}
+		return uint64(binary.BigEndian.Uint32(b[1:])), 5, nil
+	case 0x81:
+		if len(b) < 9 {
+			return 0, 0, errShort
+		}
+		return binary.BigEndian.Uint64(b[1:]), 9, nil
+	}
+
+	return 0, 0, errShort
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	conf := NewConfig()
+	conf.bind, conf.port = []string{"127.0.0.1"}, freePort(t)
+	listeners, _ := startServer(t, conf)
+	c := dialServer(t, "tcp", listeners[0].Addr().String())
+
+	c.do("SET", "k", "v")
+	c.do("EXPIRE", "k", "100")
+	payload := c.do("DUMP", "k").bulk
+	if got := c.do("DUMP", "missing"); got.typ != NULL {
+		t.Errorf("DUMP of a missing key = %+v, want null", got)
+	}
+
+	ttl := func(k string) int {
+		t.Helper()
+		return c.do("TTL", k).num
+	}
+
+	if got := c.do("RESTORE", "k", "0", payload); got.err != "BUSYKEY Target key name already exists." {
+		t.Errorf("RESTORE over an existing key = %+v, want BUSYKEY", got)
+	}
+
+	// without a TTL of its own, the key keeps the dumped one
+	if got := c.do("RESTORE", "copy", "0", payload); got.str != "OK" {
+		t.Fatalf("RESTORE = %+v", got)
+	}
+	if got := c.do("GET", "copy"); got.bulk != "v" {
+		t.Errorf("restored value = %+v, want v", got)
+	}
+	if got := ttl("copy"); got < 99 || got > 100 {
+		t.Errorf("restored TTL = %d, want the dumped 100", got)
+	}
+
+	c.do("SET", "k", "other")
+	if got := c.do("RESTORE", "k", "5000", payload, "REPLACE"); got.str != "OK" {
+		t.Fatalf("RESTORE REPLACE = %+v", got)
+	}
+	if got := c.do("GET", "k"); got.bulk != "v" {
+		t.Errorf("replaced value = %+v, want v", got)
+	}
+	if got := ttl("k"); got < 4 || got > 5 {
+		t.Errorf("replaced TTL = %d, want 5", got)
+	}
+
+	at := fmt.Sprint(time.Now().Add(50 * time.Second).UnixMilli())
+	if got := c.do("RESTORE", "abs", at, payload, "ABSTTL"); got.str != "OK" {
+		t.Fatalf("RESTORE ABSTTL = %+v", got)
+	}
+	if got := ttl("abs"); got < 49 || got > 50 {
+		t.Errorf("ABSTTL TTL = %d, want 50", got)
+	}
+
+	// an absolute TTL in the past deletes the key it replaces
+	past := fmt.Sprint(time.Now().Add(-time.Second).UnixMilli())
+	if got := c.do("RESTORE", "abs", past, payload, "ABSTTL", "REPLACE"); got.str != "OK" {
+		t.Fatalf("RESTORE ABSTTL in the past = %+v", got)
+	}
+	if got := c.do("EXISTS", "abs"); got.num != 0 {
+		t.Error("key restored with an absolute TTL in the past still exists")
+	}
+
+	if got := c.do("RESTORE", "stats", "0", payload, "IDLETIME", "50", "FREQ", "7"); got.str != "OK" {
+		t.Fatalf("RESTORE IDLETIME FREQ = %+v", got)
+	}
+	if got := c.do("OBJECT", "FREQ", "stats"); got.num != 7 {
+		t.Errorf("restored FREQ = %+v, want 7", got)
+	}
+	if got := c.do("OBJECT", "IDLETIME", "stats"); got.num != 50 {
+		t.Errorf("restored IDLETIME = %+v, want 50", got)
+	}
+
+	corrupt := []byte(payload)
+	corrupt[2] ^= 0xff
+	for name, p := range map[string]string{
+		"corrupt":   string(corrupt),
+		"truncated": payload[:len(payload)-1],
+		"empty":     "",
+	} {
+		if got := c.do("RESTORE", "bad", "0", p); got.err != "ERR "+errBadPayload.Error() {
+			t.Errorf("RESTORE of a %s payload = %+v, want %q", name, got, errBadPayload)
+		}
+	}
+	if got := c.do("EXISTS", "bad"); got.num != 0 {
+		t.Error("a bad payload created its key")
+	}
+}
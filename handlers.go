@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"log"
-	"maps"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,6 +25,7 @@ var Handlers = map[string]Handler{
 	"DBSIZE":       dbsize,
 	"AUTH":         auth,
 	"EXPIRE":       expire,
+	"PEXPIREAT":    pexpireat,
 	"TTL":          ttl,
 	"BGREWRITEAOF": bgrewriteaof,
 	"MULTI":        multi,
@@ -30,51 +33,116 @@ var Handlers = map[string]Handler{
 	"DISCARD":      discard,
 	"MONITOR":      monitor,
 	"INFO":         info,
+	"OBJECT":       object,
+	"MEMORY":       memory,
+	"DUMP":         dump,
+	"RESTORE":      restore,
+	"MIGRATE":      migrate,
+	"CONFIG":       config,
+	"PING":         ping,
+	"SUBSCRIBE":    subscribe,
+	"UNSUBSCRIBE":  unsubscribe,
+	"PSUBSCRIBE":   psubscribe,
+	"PUNSUBSCRIBE": punsubscribe,
+	"PUBLISH":      publish,
+	"PUBSUB":       pubsub,
+	"SSUBSCRIBE":   ssubscribe,
+	"SUNSUBSCRIBE": sunsubscribe,
+	"SPUBLISH":     spublish,
+	"HELLO":        hello,
+}
+
+// WriteCMDs are the commands that may appear in the AOF. Other writes are
+// logged as one of these, such as EXPIRE as PEXPIREAT, or MIGRATE as DEL.
+var WriteCMDs = []string{
+	"SET",
+	"DEL",
+	"FLUSHDB",
+	"PEXPIREAT",
+	"RESTORE",
 }
 
 var SafeCMDs = []string{
 	"COMMAND",
 	"AUTH",
+	"HELLO",
+}
+
+// SubscribedCMDs are the only commands accepted once a client subscribes
+var SubscribedCMDs = []string{
+	"SUBSCRIBE",
+	"UNSUBSCRIBE",
+	"PSUBSCRIBE",
+	"PUNSUBSCRIBE",
+	"SSUBSCRIBE",
+	"SUNSUBSCRIBE",
+	"PING",
 }
 
 func handle(c *Client, v *Value, state *AppState) {
-	cmd := v.array[0].bulk
+	// inline commands are often typed in lower case
+	cmd := strings.ToUpper(v.array[0].bulk)
 	handler, ok := Handlers[cmd]
-	w := NewWriter(c.conn)
 
 	if !ok {
-		w.Write(&Value{typ: ERROR, err: "ERR invalid command"})
-		w.Flush()
+		c.queue(&Value{typ: ERROR, err: "ERR invalid command"})
+		return
+	}
+
+	if state.conf().requirepass && !c.authenticated && !contains(SafeCMDs, cmd) {
+		c.queue(&Value{typ: ERROR, err: "NOAUTH authentication required"})
 		return
 	}
 
-	if state.conf.requirepass && !c.authenticated && !contains(SafeCMDs, cmd) {
-		w.Write(&Value{typ: ERROR, err: "NOAUTH authentication required"})
-		w.Flush()
+	// RESP3 carries messages out of band, so any command is allowed
+	if c.subscribed() && c.proto < 3 && !contains(SubscribedCMDs, cmd) {
+		c.queue(&Value{typ: ERROR, err: fmt.Sprintf(
+			"ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context",
+			strings.ToLower(cmd),
+		)})
 		return
 	}
 
 	if state.tx != nil && cmd != "EXEC" && cmd != "DISCARD" {
 		txCmd := TxCommand{v: v, handler: handler}
 		state.tx.cmds = append(state.tx.cmds, &txCmd)
-		w.Write(&Value{typ: STRING, str: "QUEUED"})
-		w.Flush()
+		c.queue(&Value{typ: STRING, str: "QUEUED"})
 		return
 	}
 
+	var appended int64
+	if state.aof != nil {
+		appended = state.aof.appended.Load()
+	}
+
+	// handlers that send several replies themselves return nil
 	reply := handler(c, v, state)
-	w.Write(reply)
-	w.Flush()
+
+	// writes reach the AOF, as appendfsync asks, before they're acknowledged
+	if state.aof != nil && state.aof.appended.Load() > appended {
+		err := state.aof.commit()
+		// with always, a write that can't be made durable can't be
+		// acknowledged either
+		if err != nil && state.conf().aofFsync == Always {
+			log.Fatal("can't recover from AOF write error when the AOF fsync policy is 'always': ", err)
+		}
+		if err != nil {
+			log.Println("error writing AOF: ", err)
+		}
+	}
+
+	if reply != nil {
+		c.queue(reply)
+	}
 
 	state.generalStats.total_commands_processed++
 
-	go func() {
-		for _, mon := range state.monitors {
-			if mon != c {
-				mon.writeMonitorLog(v)
-			}
+	// monitors only queue the log line, so a slow one can't hold us up
+	for _, mon := range state.monitors {
+		if mon != c {
+			mon.writeMonitorLog(v)
 		}
-	}()
+	}
 }
 
 func get(c *Client, v *Value, state *AppState) *Value {
@@ -108,16 +176,9 @@ func set(c *Client, v *Value, state *AppState) *Value {
 		return &Value{typ: ERROR, err: "ERR " + err.Error()}
 	}
 
-	if state.conf.aofEnabled {
-		log.Println("saving AOF record")
-		state.aof.w.Write(v)
+	propagate(state, "SET", key, val)
 
-		if state.conf.aofFsync == Always {
-			state.aof.w.Flush()
-		}
-	}
-
-	if len(state.conf.rdb) > 0 {
+	if len(state.conf().rdb) > 0 {
 		IncrRDBTrackers()
 	}
 	DB.mu.Unlock()
@@ -131,12 +192,13 @@ func del(c *Client, v *Value, state *AppState) *Value {
 
 	DB.mu.Lock()
 	for _, arg := range args {
-		_, ok := DB.store[arg.bulk]
-		DB.Delete(arg.bulk)
-		if ok {
+		if DB.Delete(arg.bulk, state) {
 			n++
 		}
 	}
+	if n > 0 {
+		propagate(state, append([]string{"DEL"}, bulks(args)...)...)
+	}
 	DB.mu.Unlock()
 
 	return &Value{typ: INTEGER, num: n}
@@ -160,7 +222,7 @@ func exists(c *Client, v *Value, state *AppState) *Value {
 
 func keys(c *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) > 1 {
+	if len(args) != 1 {
 		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'KEYS' command"}
 	}
 	pattern := args[0].bulk
@@ -180,39 +242,45 @@ func keys(c *Client, v *Value, state *AppState) *Value {
 	}
 	DB.mu.RUnlock()
 
-	reply := Value{typ: ARRAY}
-
-	for _, m := range matches {
-		reply.array = append(reply.array, Value{typ: BULK, bulk: m})
-	}
-	return &reply
+	return &Value{typ: ARRAY, stream: func(w *Writer) {
+		w.WriteArrayLen(len(matches))
+		for _, m := range matches {
+			w.WriteBulk(m)
+		}
+	}}
 }
 
 func save(c *Client, v *Value, state *AppState) *Value {
-	SaveRDB(state)
+	if state.bgsaveRunning.Load() {
+		return &Value{typ: ERROR, err: "ERR Background save already in progress"}
+	}
+
+	if err := SaveRDB(state); err != nil {
+		return &Value{typ: ERROR, err: "ERR " + err.Error()}
+	}
 	return &Value{typ: STRING, str: "OK"}
 }
 
 func bgsave(c *Client, v *Value, state *AppState) *Value {
-	if state.bgsaveRunning {
+	if !state.bgsaveRunning.CompareAndSwap(false, true) {
 		return &Value{typ: ERROR, err: "ERR background saving already in progress"}
 	}
 
-	cp := make(map[string]*Item, len(DB.store))
+	// the snapshot is taken now, and writes made while it's saved don't
+	// show up in it
 	DB.mu.RLock()
-	maps.Copy(cp, DB.store)
+	snap := DB.snapshot()
 	DB.mu.RUnlock()
 
-	state.bgsaveRunning = true
-	state.dbCopy = cp
-
 	go func() {
 		defer func() {
-			state.bgsaveRunning = false
-			state.dbCopy = nil
+			snap.release()
+			state.bgsaveRunning.Store(false)
 		}()
 
-		SaveRDB(state)
+		rdbSaveMu.Lock()
+		defer rdbSaveMu.Unlock()
+		SaveRDBSnapshot(state, snap)
 	}()
 
 	return &Value{typ: STRING, str: "OK"}
@@ -220,7 +288,8 @@ func bgsave(c *Client, v *Value, state *AppState) *Value {
 
 func flushdb(c *Client, v *Value, state *AppState) *Value {
 	DB.mu.Lock()
-	DB.store = map[string]*Item{}
+	DB.replace(map[string]*Item{})
+	propagate(state, "FLUSHDB")
 	DB.mu.Unlock()
 
 	return &Value{typ: STRING, str: "OK"}
@@ -236,12 +305,25 @@ func dbsize(c *Client, v *Value, state *AppState) *Value {
 
 func auth(c *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'AUTH' command"}
 	}
 
+	// AUTH <username> <password>, as MIGRATE sends for AUTH2. There are no
+	// ACL users, only the default one, which takes any password without
+	// requirepass.
+	if len(args) == 2 {
+		conf := state.conf()
+		if args[0].bulk != "default" || (conf.requirepass && args[1].bulk != conf.password) {
+			c.authenticated = false
+			return &Value{typ: ERROR, err: "WRONGPASS invalid username-password pair or user is disabled."}
+		}
+		c.authenticated = true
+		return &Value{typ: STRING, str: "OK"}
+	}
+
 	p := args[0].bulk
-	if state.conf.password == p {
+	if state.conf().password == p {
 		c.authenticated = true
 		return &Value{typ: STRING, str: "OK"}
 	} else {
@@ -264,13 +346,47 @@ func expire(c *Client, v *Value, state *AppState) *Value {
 		return &Value{typ: ERROR, err: "ERR invalid expiry value"}
 	}
 
-	DB.mu.RLock()
+	DB.mu.Lock()
 	key, ok := DB.store[k]
 	if !ok {
+		DB.mu.Unlock()
 		return &Value{typ: INTEGER, num: 0}
 	}
+	DB.beforeWrite(k)
 	key.Exp = time.Now().Add(time.Second * time.Duration(expSecs))
-	DB.mu.RUnlock()
+	DB.trackExpiry(k, key)
+	notifyKeyspaceEvent(state, NotifyGeneric, "expire", k)
+	// logged as an absolute time, so a replay doesn't extend the TTL
+	propagate(state, "PEXPIREAT", k, strconv.FormatInt(key.Exp.UnixMilli(), 10))
+	DB.mu.Unlock()
+
+	return &Value{typ: INTEGER, num: 1}
+}
+
+func pexpireat(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) != 2 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'PEXPIREAT' command"}
+	}
+
+	k := args[0].bulk
+	ms, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return &Value{typ: ERROR, err: "ERR invalid expiry value"}
+	}
+
+	DB.mu.Lock()
+	key, ok := DB.store[k]
+	if !ok {
+		DB.mu.Unlock()
+		return &Value{typ: INTEGER, num: 0}
+	}
+	DB.beforeWrite(k)
+	key.Exp = time.UnixMilli(ms)
+	DB.trackExpiry(k, key)
+	notifyKeyspaceEvent(state, NotifyGeneric, "expire", k)
+	propagate(state, "PEXPIREAT", k, args[1].bulk)
+	DB.mu.Unlock()
 
 	return &Value{typ: INTEGER, num: 1}
 }
@@ -283,19 +399,21 @@ func ttl(c *Client, v *Value, state *AppState) *Value {
 
 	k := args[0].bulk
 
-	DB.mu.RLock()
+	DB.mu.Lock()
 	item, ok := DB.store[k]
 	if !ok {
+		DB.mu.Unlock()
 		return &Value{typ: INTEGER, num: -2}
 	}
 	exp := item.Exp
-	DB.mu.RUnlock()
 
 	if exp.Unix() == UNIX_TS_EPOCH {
+		DB.mu.Unlock()
 		return &Value{typ: INTEGER, num: -1}
 	}
 
 	expired := DB.tryExpire(k, item, state)
+	DB.mu.Unlock()
 	if expired {
 		return &Value{typ: INTEGER, num: -2}
 	}
@@ -305,21 +423,13 @@ func ttl(c *Client, v *Value, state *AppState) *Value {
 }
 
 func bgrewriteaof(c *Client, v *Value, state *AppState) *Value {
-	go func() {
-		state.aofRewriteRunning = true
-		defer func() {
-			state.aofRewriteRunning = false
-		}()
-
-		DB.mu.RLock()
-		cp := make(map[string]*Item, len(DB.store))
-		maps.Copy(cp, DB.store)
-		DB.mu.RUnlock()
-
-		state.aof.Rewrite(cp)
+	if state.aof == nil {
+		return &Value{typ: ERROR, err: "ERR AOF is disabled"}
+	}
 
-		state.aofStats.aof_rewrites++
-	}()
+	if err := rewriteAofBackground(state); err != nil {
+		return &Value{typ: ERROR, err: "ERR " + err.Error()}
+	}
 
 	return &Value{typ: STRING, str: "Background AOF rewriting started"}
 }
@@ -342,6 +452,10 @@ func _exec(c *Client, v *Value, state *AppState) *Value {
 	replies := make([]Value, len(state.tx.cmds))
 	for i, cmd := range state.tx.cmds {
 		reply := cmd.handler(c, cmd.v, state)
+		if reply == nil {
+			// the handler already sent its replies
+			reply = &Value{typ: NULL}
+		}
 		replies[i] = *reply
 	}
 
@@ -371,6 +485,565 @@ func monitor(c *Client, v *Value, state *AppState) *Value {
 }
 
 func info(c *Client, v *Value, state *AppState) *Value {
+	if c.proto >= 3 {
+		return state.info.value(state)
+	}
+
 	msg := state.info.print(state)
 	return &Value{typ: BULK, bulk: msg}
 }
+
+func object(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) < 1 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'OBJECT' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+	if sub == "HELP" {
+		return &Value{typ: ARRAY, array: []Value{
+			{typ: STRING, str: "OBJECT <subcommand> <key>"},
+			{typ: STRING, str: "ENCODING - return the internal encoding of the value"},
+			{typ: STRING, str: "FREQ - return the number of times the key was accessed"},
+			{typ: STRING, str: "IDLETIME - return the seconds since the key was last accessed"},
+			{typ: STRING, str: "REFCOUNT - return the number of references to the value"},
+		}}
+	}
+
+	if len(args) != 2 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'OBJECT " + sub + "' command"}
+	}
+
+	k := args[1].bulk
+
+	DB.mu.RLock()
+	item, ok := DB.Peek(k)
+	if !ok {
+		DB.mu.RUnlock()
+		return &Value{typ: NULL}
+	}
+	lastAccess := item.LastAccess
+	accesses := item.Accesses
+	encoding := item.encoding()
+	DB.mu.RUnlock()
+
+	switch sub {
+	case "ENCODING":
+		return &Value{typ: BULK, bulk: encoding}
+	case "FREQ":
+		return &Value{typ: INTEGER, num: accesses}
+	case "IDLETIME":
+		if lastAccess.IsZero() {
+			return &Value{typ: INTEGER, num: 0}
+		}
+		return &Value{typ: INTEGER, num: int(time.Since(lastAccess).Seconds())}
+	case "REFCOUNT":
+		return &Value{typ: INTEGER, num: 1}
+	default:
+		return &Value{typ: ERROR, err: fmt.Sprintf("ERR unknown subcommand '%s'. Try OBJECT HELP.", args[0].bulk)}
+	}
+}
+
+func memory(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) < 1 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'MEMORY' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+	switch sub {
+	case "HELP":
+		return &Value{typ: ARRAY, array: []Value{
+			{typ: STRING, str: "MEMORY <subcommand> [<arg> ...]"},
+			{typ: STRING, str: "USAGE <key> [SAMPLES <count>] - return the approximate memory used by a key"},
+			{typ: STRING, str: "STATS - return a breakdown of the server's memory usage"},
+			{typ: STRING, str: "DOCTOR - return a report on memory problems"},
+		}}
+	case "USAGE":
+		// SAMPLES is accepted for compatibility; every value is measured exactly
+		if len(args) != 2 && !(len(args) == 4 && strings.ToUpper(args[2].bulk) == "SAMPLES") {
+			return &Value{typ: ERROR, err: "ERR syntax error"}
+		}
+		if len(args) == 4 {
+			if _, err := strconv.Atoi(args[3].bulk); err != nil {
+				return &Value{typ: ERROR, err: "ERR value is not an integer or out of range"}
+			}
+		}
+
+		k := args[1].bulk
+
+		DB.mu.RLock()
+		item, ok := DB.Peek(k)
+		if !ok {
+			DB.mu.RUnlock()
+			return &Value{typ: NULL}
+		}
+		usage := item.approxMemUsage(k)
+		DB.mu.RUnlock()
+
+		return &Value{typ: INTEGER, num: int(usage)}
+	case "STATS":
+		stats := NewMemStats(state)
+		return stats.reply()
+	case "DOCTOR":
+		stats := NewMemStats(state)
+		return &Value{typ: BULK, bulk: stats.doctor(state)}
+	default:
+		return &Value{typ: ERROR, err: fmt.Sprintf("ERR unknown subcommand '%s'. Try MEMORY HELP.", args[0].bulk)}
+	}
+}
+
+func dump(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) != 1 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'DUMP' command"}
+	}
+
+	DB.mu.RLock()
+	item, ok := DB.Peek(args[0].bulk)
+	if !ok {
+		DB.mu.RUnlock()
+		return &Value{typ: NULL}
+	}
+	payload := dumpItem(item)
+	DB.mu.RUnlock()
+
+	return &Value{typ: BULK, bulk: string(payload)}
+}
+
+func restore(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) < 3 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'RESTORE' command"}
+	}
+
+	k := args[0].bulk
+	ttl, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return &Value{typ: ERROR, err: "ERR value is not an integer or out of range"}
+	}
+	if ttl < 0 {
+		return &Value{typ: ERROR, err: "ERR Invalid TTL value, must be >= 0"}
+	}
+
+	var replace, absttl bool
+	idletime, freq := int64(-1), -1
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absttl = true
+		case "IDLETIME":
+			if i+1 >= len(args) {
+				return &Value{typ: ERROR, err: "ERR syntax error"}
+			}
+			idletime, err = strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return &Value{typ: ERROR, err: "ERR value is not an integer or out of range"}
+			}
+			if idletime < 0 {
+				return &Value{typ: ERROR, err: "ERR Invalid IDLETIME value, must be >= 0"}
+			}
+			i++
+		case "FREQ":
+			if i+1 >= len(args) {
+				return &Value{typ: ERROR, err: "ERR syntax error"}
+			}
+			freq, err = strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return &Value{typ: ERROR, err: "ERR value is not an integer or out of range"}
+			}
+			if freq < 0 || freq > 255 {
+				return &Value{typ: ERROR, err: "ERR Invalid FREQ value, must be >= 0 and <= 255"}
+			}
+			i++
+		default:
+			return &Value{typ: ERROR, err: "ERR syntax error"}
+		}
+	}
+
+	payload, err := parseDump([]byte(args[2].bulk))
+	if err != nil {
+		return &Value{typ: ERROR, err: "ERR " + err.Error()}
+	}
+
+	item := &Item{V: payload.val}
+	now := time.Now()
+	switch {
+	case ttl > 0 && absttl:
+		item.Exp = time.UnixMilli(ttl)
+	case ttl > 0:
+		item.Exp = now.Add(time.Duration(ttl) * time.Millisecond)
+	case payload.ttl > 0:
+		item.Exp = now.Add(time.Duration(payload.ttl) * time.Millisecond)
+	}
+	if idletime >= 0 {
+		item.LastAccess = now.Add(-time.Duration(idletime) * time.Second)
+	}
+	if freq >= 0 {
+		item.Accesses = freq
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	if _, ok := DB.Peek(k); ok && !replace {
+		return &Value{typ: ERROR, err: "BUSYKEY Target key name already exists."}
+	}
+
+	// an absolute TTL in the past restores nothing, but still replaces
+	if item.shouldExpire() {
+		if DB.Delete(k, state) {
+			propagate(state, "DEL", k)
+		}
+		return &Value{typ: STRING, str: "OK"}
+	}
+
+	if err := DB.SetItem(k, item, state); err != nil {
+		return &Value{typ: ERROR, err: "ERR " + err.Error()}
+	}
+	notifyKeyspaceEvent(state, NotifyGeneric, "restore", k)
+
+	// the TTL is logged as an absolute time, whichever form it arrived in
+	var absExp int64
+	if item.Exp.Unix() != UNIX_TS_EPOCH {
+		absExp = item.Exp.UnixMilli()
+	}
+	propagate(state, "RESTORE", k, strconv.FormatInt(absExp, 10), args[2].bulk, "REPLACE", "ABSTTL")
+
+	if len(state.conf().rdb) > 0 {
+		IncrRDBTrackers()
+	}
+
+	return &Value{typ: STRING, str: "OK"}
+}
+
+func migrate(c *Client, v *Value, state *AppState) *Value {
+	opts, err := parseMigrateArgs(v.array[1:])
+	if err != nil {
+		return &Value{typ: ERROR, err: "ERR " + err.Error()}
+	}
+
+	// the keys are serialized under the lock, but the transfer happens
+	// without it, so a slow target doesn't hold up every other client
+	DB.mu.RLock()
+	var keys []string
+	var sent []Item
+	var payloads [][]byte
+	for _, k := range opts.keys {
+		item, ok := DB.Peek(k)
+		if !ok {
+			continue
+		}
+		keys = append(keys, k)
+		sent = append(sent, *item)
+		payloads = append(payloads, dumpItem(item))
+	}
+	DB.mu.RUnlock()
+
+	if len(keys) == 0 {
+		return &Value{typ: STRING, str: "NOKEY"}
+	}
+
+	migrated, err := migrateKeys(opts, keys, payloads, state.conf().protoMaxBulkLen)
+
+	if !opts.copy && len(migrated) > 0 {
+		DB.mu.Lock()
+		// a key written while in flight keeps its newer value here
+		var deleted []string
+		for i, k := range keys {
+			if !slices.Contains(migrated, k) {
+				continue
+			}
+			item, ok := DB.store[k]
+			if !ok || item.V != sent[i].V || !item.Exp.Equal(sent[i].Exp) {
+				continue
+			}
+			DB.Delete(k, state)
+			deleted = append(deleted, k)
+		}
+		if len(deleted) > 0 {
+			propagate(state, append([]string{"DEL"}, deleted...)...)
+		}
+		if len(deleted) > 0 && len(state.conf().rdb) > 0 {
+			IncrRDBTrackers()
+		}
+		DB.mu.Unlock()
+	}
+
+	if err != nil {
+		return &Value{typ: ERROR, err: err.Error()}
+	}
+
+	return &Value{typ: STRING, str: "OK"}
+}
+
+func config(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) < 1 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'CONFIG' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "GET":
+		if len(args) < 2 {
+			return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'CONFIG GET' command"}
+		}
+
+		conf := state.conf()
+		reply := Value{typ: MAP}
+		for name, get := range configParams {
+			for _, pattern := range args[1:] {
+				if globMatch(strings.ToLower(pattern.bulk), name) {
+					reply.array = append(reply.array,
+						Value{typ: BULK, bulk: name},
+						Value{typ: BULK, bulk: get(conf)},
+					)
+					break
+				}
+			}
+		}
+		return &reply
+	case "SET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'CONFIG SET' command"}
+		}
+
+		// apply every pair to a copy so a bad value leaves the config
+		// untouched, and start over if another CONFIG SET got in first
+		for {
+			old := state.conf()
+			conf := *old
+			for i := 1; i < len(args); i += 2 {
+				name := strings.ToLower(args[i].bulk)
+				if !contains(configMutable, name) {
+					return &Value{typ: ERROR, err: fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i].bulk)}
+				}
+				if err := parseLine(name+" "+args[i+1].bulk, &conf); err != nil {
+					return &Value{typ: ERROR, err: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", args[i].bulk, err)}
+				}
+			}
+			if state.config.CompareAndSwap(old, &conf) {
+				break
+			}
+		}
+
+		return &Value{typ: STRING, str: "OK"}
+	default:
+		return &Value{typ: ERROR, err: fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0].bulk)}
+	}
+}
+
+func ping(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) > 1 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'PING' command"}
+	}
+
+	if c.subscribed() && c.proto < 3 {
+		msg := ""
+		if len(args) == 1 {
+			msg = args[0].bulk
+		}
+		return &Value{typ: ARRAY, array: []Value{
+			{typ: BULK, bulk: "pong"},
+			{typ: BULK, bulk: msg},
+		}}
+	}
+
+	if len(args) == 1 {
+		return &Value{typ: BULK, bulk: args[0].bulk}
+	}
+	return &Value{typ: STRING, str: "PONG"}
+}
+
+func subscribe(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) < 1 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'SUBSCRIBE' command"}
+	}
+
+	state.pubsub.subscribe(c, bulks(args), false)
+	return nil
+}
+
+func unsubscribe(c *Client, v *Value, state *AppState) *Value {
+	state.pubsub.unsubscribe(c, bulks(v.array[1:]), false)
+	return nil
+}
+
+func psubscribe(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) < 1 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'PSUBSCRIBE' command"}
+	}
+
+	state.pubsub.subscribe(c, bulks(args), true)
+	return nil
+}
+
+func punsubscribe(c *Client, v *Value, state *AppState) *Value {
+	state.pubsub.unsubscribe(c, bulks(v.array[1:]), true)
+	return nil
+}
+
+func publish(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) != 2 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'PUBLISH' command"}
+	}
+
+	n := state.pubsub.publish(args[0].bulk, args[1].bulk)
+	return &Value{typ: INTEGER, num: n}
+}
+
+func pubsub(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) < 1 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'PUBSUB' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "CHANNELS":
+		if len(args) > 2 {
+			return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'PUBSUB CHANNELS' command"}
+		}
+		pattern := "*"
+		if len(args) == 2 {
+			pattern = args[1].bulk
+		}
+
+		reply := Value{typ: ARRAY}
+		for _, ch := range state.pubsub.activeChannels(pattern) {
+			reply.array = append(reply.array, Value{typ: BULK, bulk: ch})
+		}
+		return &reply
+	case "NUMSUB":
+		reply := Value{typ: MAP}
+		for _, ch := range args[1:] {
+			reply.array = append(reply.array,
+				Value{typ: BULK, bulk: ch.bulk},
+				Value{typ: INTEGER, num: state.pubsub.numSub(ch.bulk)},
+			)
+		}
+		return &reply
+	case "SHARDCHANNELS":
+		if len(args) > 2 {
+			return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'PUBSUB SHARDCHANNELS' command"}
+		}
+		pattern := "*"
+		if len(args) == 2 {
+			pattern = args[1].bulk
+		}
+
+		reply := Value{typ: ARRAY}
+		for _, ch := range state.pubsub.activeShardChannels(pattern) {
+			reply.array = append(reply.array, Value{typ: BULK, bulk: ch})
+		}
+		return &reply
+	case "SHARDNUMSUB":
+		reply := Value{typ: MAP}
+		for _, ch := range args[1:] {
+			reply.array = append(reply.array,
+				Value{typ: BULK, bulk: ch.bulk},
+				Value{typ: INTEGER, num: state.pubsub.shardNumSub(ch.bulk)},
+			)
+		}
+		return &reply
+	case "NUMPAT":
+		if len(args) != 1 {
+			return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'PUBSUB NUMPAT' command"}
+		}
+		return &Value{typ: INTEGER, num: state.pubsub.numPat()}
+	default:
+		return &Value{typ: ERROR, err: fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[0].bulk)}
+	}
+}
+
+func ssubscribe(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) < 1 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'SSUBSCRIBE' command"}
+	}
+
+	state.pubsub.ssubscribe(c, bulks(args))
+	return nil
+}
+
+func sunsubscribe(c *Client, v *Value, state *AppState) *Value {
+	state.pubsub.sunsubscribe(c, bulks(v.array[1:]))
+	return nil
+}
+
+func spublish(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) != 2 {
+		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'SPUBLISH' command"}
+	}
+
+	n := state.pubsub.spublish(args[0].bulk, args[1].bulk)
+	return &Value{typ: INTEGER, num: n}
+}
+
+func hello(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	proto := c.proto
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil {
+			return &Value{typ: ERROR, err: "ERR Protocol version is not an integer or out of range"}
+		}
+		if n < 2 || n > 3 {
+			return &Value{typ: ERROR, err: "NOPROTO unsupported protocol version"}
+		}
+		proto = n
+	}
+
+	var name string
+	var setName bool
+	for i := 1; i < len(args); i++ {
+		left := len(args) - i - 1
+
+		switch {
+		case strings.ToUpper(args[i].bulk) == "AUTH" && left >= 2:
+			// there are no ACL users, only the default one
+			user, pass := args[i+1].bulk, args[i+2].bulk
+			// with no password set, the default user takes any password
+			conf := state.conf()
+			if user != "default" || (conf.requirepass && pass != conf.password) {
+				return &Value{typ: ERROR, err: "WRONGPASS invalid username-password pair or user is disabled."}
+			}
+			c.authenticated = true
+			i += 2
+		case strings.ToUpper(args[i].bulk) == "SETNAME" && left >= 1:
+			name, setName = args[i+1].bulk, true
+			i++
+		default:
+			return &Value{typ: ERROR, err: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].bulk)}
+		}
+	}
+
+	if state.conf().requirepass && !c.authenticated {
+		return &Value{typ: ERROR, err: "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+	}
+
+	if setName {
+		c.name = name
+	}
+	// publishers read proto under the lock to encode messages for c
+	c.mu.Lock()
+	c.proto = proto
+	c.mu.Unlock()
+
+	return &Value{typ: MAP, array: []Value{
+		{typ: BULK, bulk: "server"}, {typ: BULK, bulk: "redis"},
+		{typ: BULK, bulk: "version"}, {typ: BULK, bulk: REDIS_VERSION},
+		{typ: BULK, bulk: "proto"}, {typ: INTEGER, num: proto},
+		{typ: BULK, bulk: "id"}, {typ: INTEGER, num: int(c.id)},
+		{typ: BULK, bulk: "mode"}, {typ: BULK, bulk: "standalone"},
+		{typ: BULK, bulk: "role"}, {typ: BULK, bulk: "master"},
+		{typ: BULK, bulk: "modules"}, {typ: ARRAY},
+	}}
+}
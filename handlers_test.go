@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHandleInlineLowerCase(t *testing.T) {
+	state := newTestState(t)
+	c := NewReplayClient(state)
+	c.replay = false
+
+	r := bufio.NewReader(strings.NewReader("set k v\r\nget k\r\n"))
+	for range 2 {
+		v := Value{}
+		if err := v.readArray(r, PROTO_MAX_BULK_LEN); err != nil {
+			t.Fatal(err)
+		}
+		handle(c, &v, state)
+	}
+
+	if got := c.out.String(); got != "+OK\r\n$1\r\nv\r\n" {
+		t.Errorf("replies = %q", got)
+	}
+}
+
+func TestHelloAuth(t *testing.T) {
+	tests := []struct {
+		requirepass bool
+		user, pass  string
+		ok          bool
+	}{
+		{false, "default", "anything", true},
+		{false, "default", "", true},
+		{false, "alice", "anything", false},
+		{true, "default", "secret", true},
+		{true, "default", "wrong", false},
+		{true, "alice", "secret", false},
+	}
+
+	for _, tt := range tests {
+		state := newTestState(t)
+		conf := NewConfig()
+		conf.requirepass, conf.password = tt.requirepass, "secret"
+		if !tt.requirepass {
+			conf.password = ""
+		}
+		state.config.Store(conf)
+		c := NewReplayClient(state)
+		c.authenticated = false
+
+		reply := hello(c, commandValue("HELLO", "3", "AUTH", tt.user, tt.pass), state)
+		if ok := reply.typ == MAP; ok != tt.ok {
+			t.Errorf("requirepass %v, AUTH %s %s: replied %+v", tt.requirepass, tt.user, tt.pass, reply)
+		}
+		if ok := c.proto == 3; ok != tt.ok {
+			t.Errorf("requirepass %v, AUTH %s %s: protocol %d", tt.requirepass, tt.user, tt.pass, c.proto)
+		}
+	}
+}
+
+func TestHelloWhilePublishing(t *testing.T) {
+	state := newTestState(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	c := NewClient(server, state)
+	state.pubsub.subscribe(c, []string{"ch"}, false)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 200 {
+			state.pubsub.publish("ch", "msg")
+		}
+	}()
+	for i := range 200 {
+		hello(c, commandValue("HELLO", fmt.Sprint(2+i%2)), state)
+	}
+	<-done
+}
+
+func TestAuthWithUsername(t *testing.T) {
+	tests := []struct {
+		requirepass bool
+		args        []string
+		ok          bool
+	}{
+		{true, []string{"AUTH", "secret"}, true},
+		{true, []string{"AUTH", "default", "secret"}, true},
+		{true, []string{"AUTH", "default", "wrong"}, false},
+		{true, []string{"AUTH", "alice", "secret"}, false},
+		{false, []string{"AUTH", "default", "anything"}, true},
+		{true, []string{"AUTH", "default", "secret", "extra"}, false},
+	}
+
+	for _, tt := range tests {
+		state := newTestState(t)
+		conf := NewConfig()
+		conf.requirepass, conf.password = tt.requirepass, "secret"
+		if !tt.requirepass {
+			conf.password = ""
+		}
+		state.config.Store(conf)
+		c := NewReplayClient(state)
+		c.authenticated = false
+
+		reply := auth(c, commandValue(tt.args...), state)
+		if ok := reply.typ == STRING; ok != tt.ok || c.authenticated != tt.ok {
+			t.Errorf("requirepass %v, %v: replied %+v, authenticated %v", tt.requirepass, tt.args, reply, c.authenticated)
+		}
+	}
+}
+
+func TestSubscribedContext(t *testing.T) {
+	state := newTestState(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	c := NewClient(server, state)
+	state.pubsub.subscribe(c, []string{"ch"}, false)
+
+	handle(c, commandValue("GET", "k"), state)
+	handle(c, commandValue("PING"), state)
+
+	want := "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context\r\n" +
+		"*2\r\n$4\r\npong\r\n$0\r\n\r\n"
+	c.mu.Lock()
+	got := c.out.String()
+	c.mu.Unlock()
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("replies = %q, want suffix %q", got, want)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/shirou/gopsutil/v4/mem"
 )
 
+const REDIS_VERSION = "1.0.0"
+
 type Info struct {
 	server      map[string]string
 	client      map[string]string
@@ -34,14 +36,20 @@ func (info *Info) build(state *AppState) {
 		memTotal = memory.Total
 	}
 
+	// written under the DB lock, now also by the active expire cycle
+	DB.mu.RLock()
+	usedMem := DB.mem
+	expiredKeys, evictedKeys := state.generalStats.expired_keys, state.generalStats.evicted_keys
+	DB.mu.RUnlock()
+
 	info.server = map[string]string{
-		"redis_version":     "1.0.0",
+		"redis_version":     REDIS_VERSION,
 		"process_id":        fmt.Sprint(os.Getpid()),
-		"tcp_port":          "6379",
+		"tcp_port":          fmt.Sprint(state.conf().port),
 		"server_time_usec":  fmt.Sprint(time.Now().UnixMicro()),
 		"uptime_in_seconds": fmt.Sprint(int(time.Since(state.serverStart).Seconds())),
 		"executable":        excPath,
-		"config_file":       state.conf.config_fp,
+		"config_file":       state.conf().config_fp,
 	}
 
 	info.client = map[string]string{
@@ -49,27 +57,36 @@ func (info *Info) build(state *AppState) {
 	}
 
 	info.memory = map[string]string{
-		"used_memory":         fmt.Sprint(DB.mem),
+		"used_memory":         fmt.Sprint(usedMem),
 		"used_memory_peak":    fmt.Sprint(state.peakMem),
 		"total_system_memory": fmt.Sprint(memTotal),
-		"maxmemory":           fmt.Sprint(state.conf.maxmem),
-		"maxmemory_policy":    string(state.conf.eviction),
+		"maxmemory":           fmt.Sprint(state.conf().maxmem),
+		"maxmemory_policy":    string(state.conf().eviction),
 	}
 
 	info.persistence = map[string]string{
-		"rdb_bgsave_in_process":   fmt.Sprint(state.bgsaveRunning),
+		"rdb_bgsave_in_process":   fmt.Sprint(state.bgsaveRunning.Load()),
 		"rdb_last_save_time":      fmt.Sprint(state.rdbStats.rdb_last_save_ts),
 		"rdb_saves":               fmt.Sprint(state.rdbStats.rdb_saves),
-		"aof_enabled":             fmt.Sprint(state.conf.aofEnabled),
-		"aof_rewrite_in_progress": fmt.Sprint(state.aofRewriteRunning),
-		"aof_rewrites":            fmt.Sprint(state.aofStats.aof_rewrites),
+		"aof_enabled":             fmt.Sprint(state.conf().aofEnabled),
+		"aof_rewrite_in_progress": fmt.Sprint(state.aofRewriteRunning.Load()),
+		"aof_rewrites":            fmt.Sprint(state.aofStats.aof_rewrites.Load()),
+	}
+
+	if state.aof != nil {
+		info.persistence["aof_current_size"] = fmt.Sprint(state.aof.size())
+		info.persistence["aof_base_size"] = fmt.Sprint(state.aof.baseSize.Load())
+		info.persistence["aof_last_bgrewrite_status"] = state.aofStats.aof_last_bgrewrite_status.Load().(string)
+		info.persistence["aof_last_rewrite_time_sec"] = fmt.Sprint(state.aofStats.aof_last_rewrite_time_sec.Load())
+		info.persistence["aof_delayed_fsync"] = fmt.Sprint(state.aof.delayedFsyncs.Load())
 	}
 
 	info.general = map[string]string{
-		"total_connections_received": fmt.Sprint(state.generalStats.total_connections_received),
-		"total_commands_processed":   fmt.Sprint(state.generalStats.total_commands_processed),
-		"evicted_keys":               fmt.Sprint(state.generalStats.evicted_keys),
-		"expired_keys":               fmt.Sprint(state.generalStats.expired_keys),
+		"total_connections_received":                fmt.Sprint(state.generalStats.total_connections_received),
+		"total_commands_processed":                  fmt.Sprint(state.generalStats.total_commands_processed),
+		"evicted_keys":                              fmt.Sprint(evictedKeys),
+		"expired_keys":                              fmt.Sprint(expiredKeys),
+		"client_output_buffer_limit_disconnections": fmt.Sprint(state.generalStats.client_output_buffer_limit_disconnections.Load()),
 	}
 }
 
@@ -94,3 +111,25 @@ func (info *Info) print(state *AppState) string {
 
 	return msg
 }
+
+// value returns the sections as nested maps, for RESP3 clients.
+func (info *Info) value(state *AppState) *Value {
+	info.build(state)
+
+	category := func(header string, m map[string]string) []Value {
+		section := Value{typ: MAP}
+		for k, v := range m {
+			section.array = append(section.array, Value{typ: BULK, bulk: k}, Value{typ: BULK, bulk: v})
+		}
+		return []Value{{typ: BULK, bulk: header}, section}
+	}
+
+	reply := Value{typ: MAP}
+	reply.array = append(reply.array, category("Server", info.server)...)
+	reply.array = append(reply.array, category("Client", info.client)...)
+	reply.array = append(reply.array, category("Memory", info.memory)...)
+	reply.array = append(reply.array, category("Persistence", info.persistence)...)
+	reply.array = append(reply.array, category("General", info.general)...)
+
+	return &reply
+}
@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
 
 type Item struct {
 	V          string
@@ -20,3 +23,14 @@ func (item *Item) approxMemUsage(name string) int64 {
 
 	return int64(stringHeader + len(name) + stringHeader + len(item.V) + expHeader + mapEntrySize)
 }
+
+// encoding mirrors the string encodings reported by Redis' OBJECT ENCODING.
+func (item *Item) encoding() string {
+	if _, err := strconv.ParseInt(item.V, 10, 64); err == nil {
+		return "int"
+	}
+	if len(item.V) <= 44 {
+		return "embstr"
+	}
+	return "raw"
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listen opens every listener the config asks for: plaintext and TLS
+// listeners on each bind address, and a unix socket if one is set. Bind
+// addresses prefixed with "-" are optional, and failing to bind them isn't
+// an error.
+func listen(conf *Config) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	if conf.port > 0 {
+		tcp, err := listenTCP(conf.bind, conf.port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, tcp...)
+	}
+
+	if conf.tlsPort > 0 {
+		tlsConf, err := loadTLSConfig(conf)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+
+		tcp, err := listenTCP(conf.bind, conf.tlsPort)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		for _, l := range tcp {
+			listeners = append(listeners, tls.NewListener(l, tlsConf))
+		}
+	}
+
+	if conf.unixsocket != "" {
+		// a socket left behind by an earlier run would make Listen fail
+		if err := os.Remove(conf.unixsocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("cannot remove stale unix socket %s: %w", conf.unixsocket, err)
+		}
+
+		l, err := net.Listen("unix", conf.unixsocket)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("cannot listen on %s: %w", conf.unixsocket, err)
+		}
+		if conf.unixsocketperm != 0 {
+			if err := os.Chmod(conf.unixsocket, conf.unixsocketperm); err != nil {
+				l.Close()
+				closeListeners(listeners)
+				return nil, fmt.Errorf("cannot set permissions on %s: %w", conf.unixsocket, err)
+			}
+		}
+		log.Println("listening on", conf.unixsocket)
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no listeners configured, set port, tls-port or unixsocket")
+	}
+
+	return listeners, nil
+}
+
+func listenTCP(binds []string, port int) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	if len(binds) == 0 {
+		binds = []string{""}
+	}
+
+	for _, bind := range binds {
+		optional := strings.HasPrefix(bind, "-")
+		host := strings.TrimPrefix(bind, "-")
+		switch host {
+		case "*":
+			host = "0.0.0.0"
+		case "::*":
+			host = "::"
+		}
+
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			if optional {
+				log.Printf("skipping optional bind %s: %v", addr, err)
+				continue
+			}
+			closeListeners(listeners)
+			return nil, fmt.Errorf("cannot listen on %s: %w", addr, err)
+		}
+		log.Println("listening on", addr)
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func serve(l net.Listener, state *AppState) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		log.Println("connection accepted")
+
+		go func() {
+			handleConn(conn, state)
+		}()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestListenAllAddresses(t *testing.T) {
+	conf := NewConfig()
+	port := freePort(t)
+	// 192.0.2.1 is reserved for documentation, so it's never a local address
+	conf.bind = []string{"127.0.0.1", "127.0.0.2", "-192.0.2.1"}
+	conf.port = port
+	conf.unixsocket = path.Join(t.TempDir(), "redis.sock")
+	conf.unixsocketperm = 0700
+	// a socket file left behind by an earlier run doesn't stop the server
+	if err := os.WriteFile(conf.unixsocket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	listeners, _ := startServer(t, conf)
+
+	// the optional bind is skipped
+	if len(listeners) != 3 {
+		t.Fatalf("%d listeners, want 3", len(listeners))
+	}
+
+	conns := []*testConn{
+		dialServer(t, "tcp", fmt.Sprintf("127.0.0.1:%d", port)),
+		dialServer(t, "tcp", fmt.Sprintf("127.0.0.2:%d", port)),
+		dialServer(t, "unix", conf.unixsocket),
+	}
+	for i, c := range conns {
+		c.do("SET", fmt.Sprint("k", i), "v")
+	}
+	// every listener serves the same database
+	for _, c := range conns {
+		for i := range conns {
+			if got := c.do("GET", fmt.Sprint("k", i)); got.bulk != "v" {
+				t.Errorf("GET k%d over %s = %+v", i, c.conn.RemoteAddr(), got)
+			}
+		}
+	}
+
+	fi, err := os.Stat(conf.unixsocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0700 {
+		t.Errorf("unix socket mode is %v, want 0700", fi.Mode())
+	}
+
+	if info := conns[2].do("INFO").bulk; !strings.Contains(info, fmt.Sprintf("tcp_port:%d\n", port)) {
+		t.Errorf("INFO doesn't report tcp_port %d:\n%s", port, info)
+	}
+}
+
+func TestListenBindError(t *testing.T) {
+	conf := NewConfig()
+	conf.bind = []string{"127.0.0.1", "192.0.2.1"}
+	conf.port = freePort(t)
+
+	if listeners, err := listen(conf); err == nil {
+		closeListeners(listeners)
+		t.Fatal("listening on an address that isn't local succeeded")
+	}
+
+	// the listeners opened before the failure were closed
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", conf.port))
+	if err != nil {
+		t.Fatalf("port still held after a failed bind: %v", err)
+	}
+	l.Close()
+
+	conf = NewConfig()
+	conf.port = 0
+	if _, err := listen(conf); err == nil {
+		t.Error("listening with no port, tls-port or unixsocket succeeded")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import "errors"
+
+// LZF is the compression used for strings in RDB files. The output is a
+// series of literal runs and back references:
+//
+//	000LLLLL                    a run of L+1 literal bytes follows
+//	LLLooooo [LLLLLLLL] oooooooo copy L+2 bytes from o+1 bytes back, where a
+//	                            3 bit L of 7 is extended by the next byte
+const (
+	lzfHashBits  = 14
+	lzfMaxLit    = 32
+	lzfMaxOffset = 1 << 13
+	lzfMaxRef    = 7 + 255 + 2
+)
+
+var errLzfCorrupt = errors.New("corrupt LZF data")
+
+// lzfCompress compresses in, returning nil if the result would be longer
+// than max bytes.
+func lzfCompress(in []byte, max int) []byte {
+	if len(in) < 4 {
+		return nil
+	}
+
+	var table [1 << lzfHashBits]int
+	hash := func(i int) int {
+		v := uint32(in[i])<<16 | uint32(in[i+1])<<8 | uint32(in[i+2])
+		return int((v * 2654435761) >> (32 - lzfHashBits))
+	}
+
+	out := make([]byte, 1, len(in))
+	litPos, lit := 0, 0
+
+	endLiteral := func() {
+		if lit > 0 {
+			out[litPos] = byte(lit - 1)
+		} else {
+			out = out[:litPos]
+		}
+	}
+
+	ip := 0
+	for ip < len(in) {
+		if ip+2 < len(in) {
+			h := hash(ip)
+			ref := table[h] - 1
+			table[h] = ip + 1
+
+			off := ip - ref - 1
+			if ref >= 0 && off < lzfMaxOffset &&
+				in[ref] == in[ip] && in[ref+1] == in[ip+1] && in[ref+2] == in[ip+2] {
+				n := 3
+				for n < lzfMaxRef && ip+n < len(in) && in[ref+n] == in[ip+n] {
+					n++
+				}
+
+				endLiteral()
+				if n-2 < 7 {
+					out = append(out, byte((n-2)<<5|off>>8))
+				} else {
+					out = append(out, byte(7<<5|off>>8), byte(n-2-7))
+				}
+				out = append(out, byte(off))
+				ip += n
+
+				litPos, lit = len(out), 0
+				out = append(out, 0)
+				if len(out) > max {
+					return nil
+				}
+				continue
+			}
+		}
+
+		out = append(out, in[ip])
+		ip++
+		lit++
+		if lit == lzfMaxLit {
+			out[litPos] = lzfMaxLit - 1
+			litPos, lit = len(out), 0
+			out = append(out, 0)
+		}
+		if len(out) > max {
+			return nil
+		}
+	}
+	endLiteral()
+
+	if len(out) > max {
+		return nil
+	}
+	return out
+}
+
+// lzfDecompress expands in, which must decompress to exactly size bytes.
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < lzfMaxLit {
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > size {
+				return nil, errLzfCorrupt
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errLzfCorrupt
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errLzfCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f<<8 | int(in[i])) - 1
+		i++
+
+		n += 2
+		if ref < 0 || len(out)+n > size {
+			return nil, errLzfCorrupt
+		}
+		// byte by byte, as the reference may overlap what it's copying to
+		for j := range n {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != size {
+		return nil, errLzfCorrupt
+	}
+	return out, nil
+}
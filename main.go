@@ -2,7 +2,8 @@ package main
 
 import (
 	"bufio"
-	"fmt"
+	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"os"
@@ -10,48 +11,82 @@ import (
 
 var UNIX_TS_EPOCH int64 = -62135596800
 
+// PIPELINE_MAX_BATCH caps how many pipelined commands run between flushes
+const PIPELINE_MAX_BATCH = 1024
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-aof" {
+		os.Exit(checkAof(os.Args[2:]))
+	}
+
 	log.Println("reading config file")
 	conf := readConf("./redis.conf")
 
-	state := NewAppState(conf)
+	state, err := NewAppState(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	// as in Redis, the AOF is the whole dataset when it's enabled, and the
+	// RDB file is only loaded without it
 	if conf.aofEnabled {
 		log.Println("syncing AOF records")
-		state.aof.Sync(conf.maxmem, conf.eviction, conf.memSamples)
+		if err := state.aof.Sync(conf.maxmem, conf.eviction, conf.memSamples); err != nil {
+			log.Fatal(err)
+		}
+		InitAofAutoRewrite(state)
+	} else if len(conf.rdb) > 0 {
+		if err := SyncRDB(state); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if len(conf.rdb) > 0 {
-		SyncRDB(conf)
 		InitRDBTrackers(state)
 	}
+	InitActiveExpire(state)
 
-	l, err := net.Listen("tcp", ":6379")
+	listeners, err := listen(conf)
 	if err != nil {
-		log.Fatal("cannot listen on :6379")
+		log.Fatal(err)
 	}
-	defer l.Close()
-	log.Println("listening on :6379")
+	defer closeListeners(listeners)
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		log.Println("connection accepted")
-
-		go func() {
-			handleConn(conn, state)
-		}()
+	for _, l := range listeners[1:] {
+		go serve(l, state)
 	}
+	serve(listeners[0], state)
 }
 
 func handleConn(conn net.Conn, state *AppState) {
 	log.Println("accepted new connection: ", conn.LocalAddr().String())
-	c := NewClient(conn)
+
+	var certUser string
+	if tc, ok := conn.(*tls.Conn); ok {
+		cn, err := tlsHandshake(tc)
+		if err != nil {
+			log.Println("TLS handshake failed: ", err)
+			conn.Close()
+			return
+		}
+		certUser = cn
+	}
+
+	c := NewClient(conn, state)
 	r := bufio.NewReader(conn)
 
+	// a verified certificate authenticates the client as the user in its CN
+	if certUser != "" && state.conf().tlsAuthClientsUser == "CN" {
+		log.Println("client authenticated by TLS certificate as: ", certUser)
+		c.user = certUser
+		c.authenticated = true
+	}
+
+	go c.writeLoop()
+	defer close(c.closed)
+
+	defer state.pubsub.unsubscribeAll(c)
+
 	defer func() {
 		new := state.monitors[:0]
 		for _, mon := range state.monitors {
@@ -62,19 +97,35 @@ func handleConn(conn net.Conn, state *AppState) {
 		state.monitors = new
 	}()
 
-	state.clientCount++
-	defer func() {
-		state.clientCount--
-	}()
+	state.addClient(c)
+	defer state.removeClient(c)
 	state.generalStats.total_connections_received++
 
+	batch := 0
 	for {
 		v := Value{typ: ARRAY}
-		if err := v.readArray(r); err != nil {
+		if err := v.readArray(r, state.conf().protoMaxBulkLen); err != nil {
 			log.Println(err)
+
+			var perr *ProtocolError
+			if errors.As(err, &perr) {
+				c.send(&Value{typ: ERROR, err: "ERR " + perr.Error()})
+			}
 			break
 		}
-		handle(c, &v, state)
+		if len(v.array) > 0 {
+			handle(c, &v, state)
+			batch++
+		}
+
+		// pipelined commands that are already buffered run before the
+		// replies are flushed, so a batch costs one write instead of one
+		// per command
+		if batch < PIPELINE_MAX_BATCH && requestBuffered(r) {
+			continue
+		}
+		c.flush()
+		batch = 0
 	}
 	log.Println("connection closed: ", conn.LocalAddr().String())
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type aofFileType string
+
+const (
+	aofBase aofFileType = "b"
+	aofIncr aofFileType = "i"
+	// history files are no longer part of the AOF, and are removed once the
+	// manifest that drops them is on disk
+	aofHistory aofFileType = "h"
+)
+
+type aofFile struct {
+	name string
+	seq  int
+	typ  aofFileType
+}
+
+// aofManifest lists the files that make up the AOF, in the order they're
+// replayed: the base, then each incremental file.
+type aofManifest struct {
+	base    *aofFile
+	incrs   []*aofFile
+	history []*aofFile
+}
+
+// baseSeq and incrSeq return the sequence numbers of the newest files, which
+// new files continue from.
+func (m *aofManifest) baseSeq() int {
+	if m.base == nil {
+		return 0
+	}
+	return m.base.seq
+}
+
+func (m *aofManifest) incrSeq() int {
+	if len(m.incrs) == 0 {
+		return 0
+	}
+	return m.incrs[len(m.incrs)-1].seq
+}
+
+// files returns the files to replay, in order.
+func (m *aofManifest) files() []*aofFile {
+	var files []*aofFile
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *aofManifest) encode() []byte {
+	var b strings.Builder
+	files := append(m.files(), m.history...)
+	for _, f := range files {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", f.name, f.seq, f.typ)
+	}
+	return []byte(b.String())
+}
+
+func parseManifest(fp string) (*aofManifest, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := aofManifest{}
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid AOF manifest line %d", line)
+		}
+
+		file := aofFile{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				file.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.Atoi(fields[i+1])
+				if err != nil || seq < 0 {
+					return nil, fmt.Errorf("invalid seq in AOF manifest line %d", line)
+				}
+				file.seq = seq
+			case "type":
+				file.typ = aofFileType(fields[i+1])
+			}
+		}
+
+		// names are relative to the AOF directory
+		if file.name == "" || file.name != path.Base(file.name) {
+			return nil, fmt.Errorf("invalid file name in AOF manifest line %d", line)
+		}
+
+		switch file.typ {
+		case aofBase:
+			if m.base != nil {
+				return nil, errors.New("AOF manifest has more than one base file")
+			}
+			m.base = &file
+		case aofIncr:
+			if m.incrSeq() >= file.seq {
+				return nil, fmt.Errorf("AOF manifest incr files out of order at line %d", line)
+			}
+			m.incrs = append(m.incrs, &file)
+		case aofHistory:
+			m.history = append(m.history, &file)
+		default:
+			return nil, fmt.Errorf("invalid file type in AOF manifest line %d", line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// writeManifest replaces the manifest in dir atomically.
+func writeManifest(dir string, name string, m *aofManifest) error {
+	tmp := path.Join(dir, "temp-"+name)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(m.encode()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, path.Join(dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
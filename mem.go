@@ -1,12 +1,17 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 type sample struct {
 	k string
 	v *Item
 }
 
 func sampleKeys(state *AppState) []sample {
-	maxSamples := state.conf.memSamples
+	maxSamples := state.conf().memSamples
 	samples := make([]sample, 0, maxSamples)
 
 	for k, v := range DB.store {
@@ -21,3 +26,119 @@ func sampleKeys(state *AppState) []sample {
 
 	return samples
 }
+
+// every connection holds a bufio.Reader with the default buffer size, on top
+// of its pending output
+const clientBufSize = 4096
+
+type MemStats struct {
+	peak      int64
+	dataset   int64
+	overhead  int64
+	clients   int64
+	aofBuffer int64
+	keys      int
+}
+
+func NewMemStats(state *AppState) *MemStats {
+	stats := MemStats{peak: state.peakMem}
+
+	DB.mu.RLock()
+	for k, v := range DB.store {
+		stats.dataset += int64(len(k) + len(v.V))
+	}
+	stats.keys = len(DB.store)
+	stats.overhead = DB.mem - stats.dataset
+	DB.mu.RUnlock()
+
+	state.clientsMu.Lock()
+	for c := range state.clients {
+		c.mu.Lock()
+		stats.clients += clientBufSize + int64(c.out.Len()+c.inflight)
+		c.mu.Unlock()
+	}
+	state.clientsMu.Unlock()
+
+	if state.conf().aofEnabled {
+		state.aof.mu.Lock()
+		if state.aof.w != nil {
+			stats.aofBuffer = int64(state.aof.w.Buffered())
+		}
+		state.aof.mu.Unlock()
+	}
+
+	return &stats
+}
+
+func (stats *MemStats) total() int64 {
+	return stats.dataset + stats.overhead + stats.clients + stats.aofBuffer
+}
+
+func (stats *MemStats) reply() *Value {
+	var bytesPerKey int64
+	if stats.keys > 0 {
+		bytesPerKey = (stats.dataset + stats.overhead) / int64(stats.keys)
+	}
+
+	var datasetPct float64
+	if total := stats.total(); total > 0 {
+		datasetPct = float64(stats.dataset) / float64(total) * 100
+	}
+
+	fields := []struct {
+		name string
+		val  Value
+	}{
+		{"peak.allocated", Value{typ: INTEGER, num: int(stats.peak)}},
+		{"total.allocated", Value{typ: INTEGER, num: int(stats.total())}},
+		{"overhead.total", Value{typ: INTEGER, num: int(stats.overhead + stats.clients + stats.aofBuffer)}},
+		{"overhead.hashtable.main", Value{typ: INTEGER, num: int(stats.overhead)}},
+		{"clients.normal", Value{typ: INTEGER, num: int(stats.clients)}},
+		{"aof.buffer", Value{typ: INTEGER, num: int(stats.aofBuffer)}},
+		{"keys.count", Value{typ: INTEGER, num: stats.keys}},
+		{"keys.bytes-per-key", Value{typ: INTEGER, num: int(bytesPerKey)}},
+		{"dataset.bytes", Value{typ: INTEGER, num: int(stats.dataset)}},
+		{"dataset.percentage", Value{typ: DOUBLE, double: datasetPct}},
+	}
+
+	reply := Value{typ: MAP}
+	for _, f := range fields {
+		reply.array = append(reply.array, Value{typ: BULK, bulk: f.name}, f.val)
+	}
+	return &reply
+}
+
+func (stats *MemStats) doctor(state *AppState) string {
+	var issues []string
+
+	maxmem := state.conf().maxmem
+	if maxmem > 0 {
+		used := stats.dataset + stats.overhead
+		if used*100 >= maxmem*90 {
+			issues = append(issues, fmt.Sprintf(
+				"Dataset is using %d of %d bytes of maxmemory. Expect evictions (policy: %s) or write errors.",
+				used, maxmem, state.conf().eviction,
+			))
+		}
+		if state.conf().eviction == NoEviction || state.conf().eviction == "" {
+			issues = append(issues, "maxmemory is set but no eviction policy is selected, so writes fail once the limit is reached.")
+		}
+	}
+
+	if stats.keys > 0 && stats.overhead > stats.dataset {
+		issues = append(issues, fmt.Sprintf(
+			"Per-key overhead (%d bytes) is larger than the data itself (%d bytes). Many small keys are expensive; consider fewer, larger values.",
+			stats.overhead, stats.dataset,
+		))
+	}
+
+	if stats.aofBuffer > 0 && state.conf().aofFsync == No {
+		issues = append(issues, fmt.Sprintf("AOF buffer holds %d bytes not yet written to disk.", stats.aofBuffer))
+	}
+
+	if len(issues) == 0 {
+		return "I can't find any memory issue in this instance."
+	}
+
+	return "Memory issues detected:\n\n * " + strings.Join(issues, "\n\n * ") + "\n"
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectCommands(t *testing.T) {
+	conf := NewConfig()
+	conf.bind, conf.port = []string{"127.0.0.1"}, freePort(t)
+	listeners, _ := startServer(t, conf)
+	c := dialServer(t, "tcp", listeners[0].Addr().String())
+
+	c.do("SET", "int", "12345")
+	c.do("SET", "short", "hello")
+	c.do("SET", "long", strings.Repeat("x", 45))
+	for k, want := range map[string]string{"int": "int", "short": "embstr", "long": "raw"} {
+		if got := c.do("OBJECT", "ENCODING", k); got.bulk != want {
+			t.Errorf("OBJECT ENCODING %s = %+v, want %s", k, got, want)
+		}
+	}
+
+	// OBJECT reads keys without counting as an access
+	for range 3 {
+		c.do("GET", "short")
+	}
+	for range 2 {
+		if got := c.do("OBJECT", "FREQ", "short"); got.typ != INTEGER || got.num != 3 {
+			t.Errorf("OBJECT FREQ = %+v, want 3", got)
+		}
+	}
+	if got := c.do("OBJECT", "IDLETIME", "short"); got.typ != INTEGER || got.num != 0 {
+		t.Errorf("OBJECT IDLETIME just after GET = %+v, want 0", got)
+	}
+
+	DB.mu.Lock()
+	DB.store["short"].LastAccess = time.Now().Add(-100 * time.Second)
+	DB.mu.Unlock()
+	if got := c.do("OBJECT", "IDLETIME", "short"); got.typ != INTEGER || got.num != 100 {
+		t.Errorf("OBJECT IDLETIME = %+v, want 100", got)
+	}
+
+	for _, sub := range []string{"ENCODING", "FREQ", "IDLETIME"} {
+		if got := c.do("OBJECT", sub, "missing"); got.typ != NULL {
+			t.Errorf("OBJECT %s of a missing key = %+v, want null", sub, got)
+		}
+	}
+}
+
+func TestMemoryCommands(t *testing.T) {
+	conf := NewConfig()
+	conf.bind, conf.port = []string{"127.0.0.1"}, freePort(t)
+	listeners, state := startServer(t, conf)
+	c := dialServer(t, "tcp", listeners[0].Addr().String())
+
+	c.do("SET", "a", "1")
+	c.do("SET", "bb", "value")
+
+	want := (&Item{V: "value"}).approxMemUsage("bb")
+	for _, args := range [][]string{{"MEMORY", "USAGE", "bb"}, {"MEMORY", "USAGE", "bb", "SAMPLES", "5"}} {
+		if got := c.do(args...); got.typ != INTEGER || int64(got.num) != want {
+			t.Errorf("%v = %+v, want %d", args, got, want)
+		}
+	}
+	if got := c.do("MEMORY", "USAGE", "missing"); got.typ != NULL {
+		t.Errorf("MEMORY USAGE of a missing key = %+v, want null", got)
+	}
+	if got := c.do("MEMORY", "USAGE", "bb", "SAMPLES", "x"); got.typ != ERROR {
+		t.Errorf("MEMORY USAGE with bad SAMPLES = %+v, want an error", got)
+	}
+
+	// stats reads MEMORY STATS, which RESP2 flattens into name, value pairs
+	stats := func() map[string]Value {
+		t.Helper()
+		reply := c.do("MEMORY", "STATS")
+		fields := map[string]Value{}
+		for i := 0; i+1 < len(reply.array); i += 2 {
+			fields[reply.array[i].bulk] = reply.array[i+1]
+		}
+		return fields
+	}
+
+	DB.mu.RLock()
+	overhead := int(DB.mem) - len("a1bbvalue")
+	DB.mu.RUnlock()
+	fields := stats()
+	for name, want := range map[string]int{
+		"keys.count":              2,
+		"dataset.bytes":           len("a1bbvalue"),
+		"overhead.hashtable.main": overhead,
+		"aof.buffer":              0,
+	} {
+		if got := fields[name]; got.typ != INTEGER || got.num != want {
+			t.Errorf("MEMORY STATS %s = %+v, want %d", name, got, want)
+		}
+	}
+	// the connection's read buffer counts towards client memory
+	if got := fields["clients.normal"]; got.num < clientBufSize {
+		t.Errorf("MEMORY STATS clients.normal = %+v, want at least %d", got, clientBufSize)
+	}
+
+	// FLUSHDB leaves no overhead behind
+	c.do("FLUSHDB")
+	fields = stats()
+	for _, name := range []string{"keys.count", "dataset.bytes", "overhead.hashtable.main"} {
+		if got := fields[name]; got.typ != INTEGER || got.num != 0 {
+			t.Errorf("MEMORY STATS %s after FLUSHDB = %+v, want 0", name, got)
+		}
+	}
+	if got := c.do("MEMORY", "DOCTOR"); !strings.Contains(got.bulk, "can't find any memory issue") {
+		t.Errorf("MEMORY DOCTOR on an empty database = %q", got.bulk)
+	}
+
+	c.do("SET", "a", "1")
+	limited := NewConfig()
+	limited.maxmem, limited.eviction = 1, NoEviction
+	state.config.Store(limited)
+	got := c.do("MEMORY", "DOCTOR").bulk
+	for _, issue := range []string{"Expect evictions", "no eviction policy", "Per-key overhead"} {
+		if !strings.Contains(got, issue) {
+			t.Errorf("MEMORY DOCTOR over maxmemory doesn't report %q:\n%s", issue, got)
+		}
+	}
+}
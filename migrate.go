@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type migrateOpts struct {
+	addr     string
+	keys     []string
+	db       int
+	timeout  time.Duration
+	copy     bool
+	replace  bool
+	username string
+	password string
+}
+
+func parseMigrateArgs(args []Value) (*migrateOpts, error) {
+	if len(args) < 5 {
+		return nil, errors.New("invalid number of arguments for 'MIGRATE' command")
+	}
+
+	db, err := strconv.Atoi(args[3].bulk)
+	if err != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+
+	timeout, err := strconv.Atoi(args[4].bulk)
+	if err != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	opts := migrateOpts{
+		addr:    net.JoinHostPort(args[0].bulk, args[1].bulk),
+		db:      db,
+		timeout: time.Duration(timeout) * time.Millisecond,
+	}
+
+	for i := 5; i < len(args); i++ {
+		left := len(args) - i - 1
+
+		switch strings.ToUpper(args[i].bulk) {
+		case "COPY":
+			opts.copy = true
+		case "REPLACE":
+			opts.replace = true
+		case "AUTH":
+			if left < 1 {
+				return nil, errors.New("syntax error")
+			}
+			opts.password = args[i+1].bulk
+			i++
+		case "AUTH2":
+			if left < 2 {
+				return nil, errors.New("syntax error")
+			}
+			opts.username, opts.password = args[i+1].bulk, args[i+2].bulk
+			i += 2
+		case "KEYS":
+			if args[2].bulk != "" {
+				return nil, errors.New("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, k := range args[i+1:] {
+				opts.keys = append(opts.keys, k.bulk)
+			}
+			i = len(args)
+		default:
+			return nil, errors.New("syntax error")
+		}
+	}
+
+	if len(opts.keys) == 0 {
+		opts.keys = []string{args[2].bulk}
+	}
+
+	// this server only has a single database
+	if opts.db != 0 {
+		return nil, errors.New("destination-db must be 0")
+	}
+
+	return &opts, nil
+}
+
+// migrateKeys pipelines a RESTORE for every payload to the target instance
+// and returns the keys it accepted. A non-nil error describes the first
+// failure, and keys after it may still have been restored. Replies with bulks
+// over maxBulkLen are treated as a broken connection.
+func migrateKeys(opts *migrateOpts, keys []string, payloads [][]byte, maxBulkLen int64) ([]string, error) {
+	conn, err := net.DialTimeout("tcp", opts.addr, opts.timeout)
+	if err != nil {
+		return nil, errors.New("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(opts.timeout))
+
+	w := NewWriter(conn)
+	r := bufio.NewReader(conn)
+
+	command := func(args ...string) *Value {
+		cmd := Value{typ: ARRAY}
+		for _, arg := range args {
+			cmd.array = append(cmd.array, Value{typ: BULK, bulk: arg})
+		}
+		return &cmd
+	}
+
+	replies := 0
+	if opts.password != "" {
+		if opts.username != "" {
+			w.Write(command("AUTH", opts.username, opts.password))
+		} else {
+			w.Write(command("AUTH", opts.password))
+		}
+		replies++
+	}
+
+	for i, k := range keys {
+		args := []string{"RESTORE", k, "0", string(payloads[i])}
+		if opts.replace {
+			args = append(args, "REPLACE")
+		}
+		w.Write(command(args...))
+	}
+	w.Flush()
+
+	var migrated []string
+	var firstErr error
+	for i := range replies + len(keys) {
+		reply := Value{}
+		if err := reply.read(r, maxBulkLen); err != nil {
+			return migrated, errors.New("IOERR error or timeout reading to target instance")
+		}
+
+		if reply.typ == ERROR {
+			if firstErr == nil {
+				firstErr = errors.New("ERR Target instance replied with error: " + reply.err)
+			}
+			// nothing was restored if authentication failed
+			if i < replies {
+				return nil, firstErr
+			}
+			continue
+		}
+
+		if i >= replies {
+			migrated = append(migrated, keys[i-replies])
+		}
+	}
+
+	return migrated, firstErr
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestState resets the global database and returns a state with the
+// default config and no persistence.
+func newTestState(t *testing.T) *AppState {
+	t.Helper()
+	DB = NewDatabase()
+	state, err := NewAppState(NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// serveTarget runs a second instance for MIGRATE to talk to. It restores
+// payloads into its own store, which it sends on done once the connection
+// is closed. reply, when set, replaces the reply to every RESTORE.
+func serveTarget(t *testing.T, reply string) (host string, port string, done chan map[string]*dumpPayload) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	done = make(chan map[string]*dumpPayload, 1)
+	go func() {
+		store := map[string]*dumpPayload{}
+		defer func() { done <- store }()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for {
+			v := Value{}
+			if err := v.readArray(r, PROTO_MAX_BULK_LEN); err != nil {
+				return
+			}
+			if reply != "" {
+				conn.Write([]byte(reply))
+				continue
+			}
+
+			switch strings.ToUpper(v.array[0].bulk) {
+			case "AUTH":
+				conn.Write([]byte("+OK\r\n"))
+			case "RESTORE":
+				k := v.array[1].bulk
+				if _, ok := store[k]; ok && len(v.array) < 5 {
+					conn.Write([]byte("-BUSYKEY Target key name already exists.\r\n"))
+					continue
+				}
+				p, err := parseDump([]byte(v.array[3].bulk))
+				if err != nil {
+					conn.Write([]byte("-ERR " + err.Error() + "\r\n"))
+					continue
+				}
+				store[k] = p
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}
+	}()
+
+	host, port, _ = net.SplitHostPort(l.Addr().String())
+	return host, port, done
+}
+
+func TestMigrateMovesKeys(t *testing.T) {
+	state := newTestState(t)
+	c := NewReplayClient(state)
+
+	DB.mu.Lock()
+	DB.Set("a", "1", state)
+	DB.SetItem("b", &Item{V: "2", Exp: time.Now().Add(time.Hour)}, state)
+	DB.mu.Unlock()
+
+	host, port, done := serveTarget(t, "")
+	reply := migrate(c, commandValue("MIGRATE", host, port, "", "0", "1000", "AUTH", "secret", "KEYS", "a", "b", "missing"), state)
+	if reply.typ != STRING || reply.str != "OK" {
+		t.Fatalf("MIGRATE replied %+v", reply)
+	}
+
+	DB.mu.RLock()
+	if len(DB.store) != 0 {
+		t.Errorf("%d keys left on the source", len(DB.store))
+	}
+	DB.mu.RUnlock()
+
+	// the connection is closed once MIGRATE returns
+	target := <-done
+	if len(target) != 2 || target["a"].val != "1" || target["b"].val != "2" {
+		t.Fatalf("target holds %+v", target)
+	}
+	if target["a"].ttl != 0 || target["b"].ttl <= 0 {
+		t.Errorf("ttls not migrated: a=%d b=%d", target["a"].ttl, target["b"].ttl)
+	}
+}
+
+func TestMigrateCopyKeepsKeys(t *testing.T) {
+	state := newTestState(t)
+	c := NewReplayClient(state)
+
+	DB.mu.Lock()
+	DB.Set("a", "1", state)
+	DB.mu.Unlock()
+
+	host, port, done := serveTarget(t, "")
+	reply := migrate(c, commandValue("MIGRATE", host, port, "a", "0", "1000", "COPY"), state)
+	if reply.typ != STRING || reply.str != "OK" {
+		t.Fatalf("MIGRATE replied %+v", reply)
+	}
+	if _, ok := DB.Peek("a"); !ok {
+		t.Error("COPY removed the key from the source")
+	}
+	if target := <-done; target["a"] == nil {
+		t.Error("key not copied to the target")
+	}
+}
+
+func TestMigrateTargetError(t *testing.T) {
+	state := newTestState(t)
+	c := NewReplayClient(state)
+
+	DB.mu.Lock()
+	DB.Set("a", "1", state)
+	DB.mu.Unlock()
+
+	host, port, _ := serveTarget(t, "-BUSYKEY Target key name already exists.\r\n")
+	reply := migrate(c, commandValue("MIGRATE", host, port, "a", "0", "1000"), state)
+	if reply.typ != ERROR || !strings.Contains(reply.err, "BUSYKEY") {
+		t.Fatalf("MIGRATE replied %+v", reply)
+	}
+	if _, ok := DB.Peek("a"); !ok {
+		t.Error("key removed although the target refused it")
+	}
+}
+
+func TestMigrateRejectsHugeBulkReply(t *testing.T) {
+	state := newTestState(t)
+	c := NewReplayClient(state)
+
+	DB.mu.Lock()
+	DB.Set("a", "1", state)
+	DB.mu.Unlock()
+
+	// a broken target must not make this server allocate what it claims
+	host, port, _ := serveTarget(t, "$9223372036854775806\r\n")
+	reply := migrate(c, commandValue("MIGRATE", host, port, "a", "0", "1000"), state)
+	if reply.typ != ERROR || !strings.HasPrefix(reply.err, "IOERR") {
+		t.Fatalf("MIGRATE replied %+v", reply)
+	}
+	if _, ok := DB.Peek("a"); !ok {
+		t.Error("key removed although the target never accepted it")
+	}
+}
+
+func TestMigrateDoesNotBlockClients(t *testing.T) {
+	state := newTestState(t)
+	c := NewReplayClient(state)
+
+	DB.mu.Lock()
+	DB.Set("a", "1", state)
+	DB.Set("b", "2", state)
+	DB.Set("other", "x", state)
+	DB.mu.Unlock()
+
+	// a target that accepts the keys only once released
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for range 2 {
+			v := Value{}
+			if err := v.readArray(r, PROTO_MAX_BULK_LEN); err != nil {
+				return
+			}
+		}
+		close(received)
+		<-release
+		conn.Write([]byte("+OK\r\n+OK\r\n"))
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	done := make(chan *Value)
+	go func() {
+		done <- migrate(c, commandValue("MIGRATE", host, port, "", "0", "5000", "KEYS", "a", "b"), state)
+	}()
+	<-received
+
+	// clients carry on while the keys are in flight
+	finished := make(chan struct{})
+	go func() {
+		set(c, commandValue("SET", "other", "y"), state)
+		set(c, commandValue("SET", "b", "changed"), state)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("writes blocked while MIGRATE waits on the target")
+	}
+
+	close(release)
+	if reply := <-done; reply.typ != STRING || reply.str != "OK" {
+		t.Fatalf("MIGRATE replied %+v", reply)
+	}
+
+	// a key changed while in flight keeps its newer value
+	if _, ok := DB.Peek("a"); ok {
+		t.Error("migrated key a left on the source")
+	}
+	if item, ok := DB.Peek("b"); !ok || item.V != "changed" {
+		t.Errorf("b = %+v, want the value written during MIGRATE", item)
+	}
+}
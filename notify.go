@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+type NotifyFlags int
+
+const (
+	NotifyKeyspace NotifyFlags = 1 << iota // K
+	NotifyKeyevent                         // E
+	NotifyGeneric                          // g
+	NotifyString                           // $
+	NotifyList                             // l
+	NotifySet                              // s
+	NotifyHash                             // h
+	NotifyZset                             // z
+	NotifyExpired                          // x
+	NotifyEvicted                          // e
+	NotifyStream                           // t
+	NotifyKeyMiss                          // m
+	NotifyModule                           // d
+	NotifyNew                              // n
+
+	// A, which deliberately leaves out m and n
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash |
+		NotifyZset | NotifyExpired | NotifyEvicted | NotifyStream | NotifyModule
+)
+
+var notifyFlagChars = []struct {
+	c    byte
+	flag NotifyFlags
+}{
+	{'g', NotifyGeneric},
+	{'$', NotifyString},
+	{'l', NotifyList},
+	{'s', NotifySet},
+	{'h', NotifyHash},
+	{'z', NotifyZset},
+	{'x', NotifyExpired},
+	{'e', NotifyEvicted},
+	{'t', NotifyStream},
+	{'d', NotifyModule},
+	{'K', NotifyKeyspace},
+	{'E', NotifyKeyevent},
+	{'m', NotifyKeyMiss},
+	{'n', NotifyNew},
+}
+
+func parseNotifyFlags(s string) (NotifyFlags, error) {
+	var flags NotifyFlags
+
+outer:
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= NotifyAll
+			continue
+		}
+		for _, fc := range notifyFlagChars {
+			if fc.c == s[i] {
+				flags |= fc.flag
+				continue outer
+			}
+		}
+		return 0, errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+	}
+
+	return flags, nil
+}
+
+func (flags NotifyFlags) String() string {
+	var b strings.Builder
+
+	if flags&NotifyAll == NotifyAll {
+		b.WriteByte('A')
+	}
+	for _, fc := range notifyFlagChars {
+		if flags&NotifyAll == NotifyAll && fc.flag&NotifyAll != 0 {
+			continue
+		}
+		if flags&fc.flag != 0 {
+			b.WriteByte(fc.c)
+		}
+	}
+
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes event for key on the keyspace and keyevent
+// channels, if the event's class is enabled by notify-keyspace-events.
+// Only database 0 exists, so it's hardcoded in the channel names.
+func notifyKeyspaceEvent(state *AppState, class NotifyFlags, event string, key string) {
+	flags := state.conf().notifyFlags
+	if flags&class == 0 {
+		return
+	}
+
+	if flags&NotifyKeyspace != 0 {
+		state.pubsub.publish("__keyspace@0__:"+key, event)
+	}
+	if flags&NotifyKeyevent != 0 {
+		state.pubsub.publish("__keyevent@0__:"+event, key)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+type PubSub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*Client]struct{}
+	patterns map[string]map[*Client]struct{}
+	// shard channels are grouped by hash slot, so a slot's subscribers can
+	// be found without scanning every channel
+	shards map[int]map[string]map[*Client]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: map[string]map[*Client]struct{}{},
+		patterns: map[string]map[*Client]struct{}{},
+		shards:   map[int]map[string]map[*Client]struct{}{},
+	}
+}
+
+func pubsubReply(kind string, target string, count int) *Value {
+	return &Value{typ: PUSH, array: []Value{
+		{typ: BULK, bulk: kind},
+		{typ: BULK, bulk: target},
+		{typ: INTEGER, num: count},
+	}}
+}
+
+// registry returns the server-side map and the client-side set for either
+// channels or patterns.
+func (ps *PubSub) registry(c *Client, pattern bool) (map[string]map[*Client]struct{}, map[string]struct{}) {
+	if pattern {
+		return ps.patterns, c.psubs
+	}
+	return ps.channels, c.subs
+}
+
+// subscribe registers c and sends one confirmation per target. Confirmations
+// are queued while the lock is held, so they always precede the first
+// message published to a new subscription.
+func (ps *PubSub) subscribe(c *Client, targets []string, pattern bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+
+	all, own := ps.registry(c, pattern)
+	for _, t := range targets {
+		if _, ok := own[t]; !ok {
+			own[t] = struct{}{}
+			if all[t] == nil {
+				all[t] = map[*Client]struct{}{}
+			}
+			all[t][c] = struct{}{}
+		}
+		c.send(pubsubReply(kind, t, c.subscriptions()))
+	}
+}
+
+// unsubscribe removes c from targets, or from everything it's subscribed to
+// if targets is empty, sending one confirmation per target.
+func (ps *PubSub) unsubscribe(c *Client, targets []string, pattern bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+
+	all, own := ps.registry(c, pattern)
+	if len(targets) == 0 {
+		for t := range own {
+			targets = append(targets, t)
+		}
+		sort.Strings(targets)
+	}
+
+	if len(targets) == 0 {
+		c.send(&Value{typ: PUSH, array: []Value{
+			{typ: BULK, bulk: kind},
+			{typ: NULL},
+			{typ: INTEGER, num: c.subscriptions()},
+		}})
+		return
+	}
+
+	for _, t := range targets {
+		ps.remove(all, own, c, t)
+		c.send(pubsubReply(kind, t, c.subscriptions()))
+	}
+}
+
+func (ps *PubSub) unsubscribeAll(c *Client) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for t := range c.subs {
+		ps.remove(ps.channels, c.subs, c, t)
+	}
+	for t := range c.psubs {
+		ps.remove(ps.patterns, c.psubs, c, t)
+	}
+	for t := range c.ssubs {
+		ps.removeShard(c, t)
+	}
+}
+
+func (ps *PubSub) remove(all map[string]map[*Client]struct{}, own map[string]struct{}, c *Client, t string) {
+	delete(own, t)
+	delete(all[t], c)
+	if len(all[t]) == 0 {
+		delete(all, t)
+	}
+}
+
+// publish queues msg for every client subscribed to channel, either directly
+// or through a pattern, and returns the number of deliveries. It never waits
+// on subscribers' connections.
+func (ps *PubSub) publish(channel string, msg string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var n int
+	for c := range ps.channels[channel] {
+		c.send(&Value{typ: PUSH, array: []Value{
+			{typ: BULK, bulk: "message"},
+			{typ: BULK, bulk: channel},
+			{typ: BULK, bulk: msg},
+		}})
+		n++
+	}
+
+	for pattern, clients := range ps.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for c := range clients {
+			c.send(&Value{typ: PUSH, array: []Value{
+				{typ: BULK, bulk: "pmessage"},
+				{typ: BULK, bulk: pattern},
+				{typ: BULK, bulk: channel},
+				{typ: BULK, bulk: msg},
+			}})
+			n++
+		}
+	}
+
+	return n
+}
+
+func (ps *PubSub) activeChannels(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var channels []string
+	for ch := range ps.channels {
+		if globMatch(pattern, ch) {
+			channels = append(channels, ch)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (ps *PubSub) numSub(channel string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.channels[channel])
+}
+
+func (ps *PubSub) numPat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.patterns)
+}
+
+// ssubscribe registers c to shard channels. Unlike classic channels, each
+// shard channel belongs to the hash slot of its name, and only the slot's
+// owner delivers its messages. Standalone servers own every slot.
+func (ps *PubSub) ssubscribe(c *Client, channels []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for _, ch := range channels {
+		if _, ok := c.ssubs[ch]; !ok {
+			c.ssubs[ch] = struct{}{}
+
+			slot := keyHashSlot(ch)
+			if ps.shards[slot] == nil {
+				ps.shards[slot] = map[string]map[*Client]struct{}{}
+			}
+			if ps.shards[slot][ch] == nil {
+				ps.shards[slot][ch] = map[*Client]struct{}{}
+			}
+			ps.shards[slot][ch][c] = struct{}{}
+		}
+		c.send(pubsubReply("ssubscribe", ch, len(c.ssubs)))
+	}
+}
+
+func (ps *PubSub) sunsubscribe(c *Client, channels []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if len(channels) == 0 {
+		for ch := range c.ssubs {
+			channels = append(channels, ch)
+		}
+		sort.Strings(channels)
+	}
+
+	if len(channels) == 0 {
+		c.send(&Value{typ: PUSH, array: []Value{
+			{typ: BULK, bulk: "sunsubscribe"},
+			{typ: NULL},
+			{typ: INTEGER, num: len(c.ssubs)},
+		}})
+		return
+	}
+
+	for _, ch := range channels {
+		ps.removeShard(c, ch)
+		c.send(pubsubReply("sunsubscribe", ch, len(c.ssubs)))
+	}
+}
+
+func (ps *PubSub) removeShard(c *Client, ch string) {
+	slot := keyHashSlot(ch)
+
+	delete(c.ssubs, ch)
+	delete(ps.shards[slot][ch], c)
+	if len(ps.shards[slot][ch]) == 0 {
+		delete(ps.shards[slot], ch)
+	}
+	if len(ps.shards[slot]) == 0 {
+		delete(ps.shards, slot)
+	}
+}
+
+// spublish delivers msg to the subscribers of a shard channel. Patterns never
+// match shard channels.
+func (ps *PubSub) spublish(channel string, msg string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var n int
+	for c := range ps.shards[keyHashSlot(channel)][channel] {
+		c.send(&Value{typ: PUSH, array: []Value{
+			{typ: BULK, bulk: "smessage"},
+			{typ: BULK, bulk: channel},
+			{typ: BULK, bulk: msg},
+		}})
+		n++
+	}
+
+	return n
+}
+
+func (ps *PubSub) activeShardChannels(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var channels []string
+	for _, slot := range ps.shards {
+		for ch := range slot {
+			if globMatch(pattern, ch) {
+				channels = append(channels, ch)
+			}
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (ps *PubSub) shardNumSub(channel string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.shards[keyHashSlot(channel)][channel])
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+)
+
+// fields flattens a reply into strings for comparison, with nil for nulls.
+func fields(v Value) []string {
+	var fs []string
+	for _, e := range v.array {
+		switch e.typ {
+		case INTEGER:
+			fs = append(fs, fmt.Sprint(e.num))
+		case NULL:
+			fs = append(fs, "nil")
+		case ARRAY:
+			fs = append(fs, fields(e)...)
+		default:
+			fs = append(fs, e.bulk)
+		}
+	}
+	return fs
+}
+
+// expect checks the next replies c reads, each given as its fields.
+func (c *testConn) expect(replies ...[]string) {
+	c.t.Helper()
+
+	for _, want := range replies {
+		if got := fields(c.next()); !slices.Equal(got, want) {
+			c.t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	conf := NewConfig()
+	conf.bind, conf.port = []string{"127.0.0.1"}, freePort(t)
+	listeners, _ := startServer(t, conf)
+	addr := listeners[0].Addr().String()
+	sub, other, pub := dialServer(t, "tcp", addr), dialServer(t, "tcp", addr), dialServer(t, "tcp", addr)
+
+	sub.send("SUBSCRIBE", "a", "b", "a")
+	sub.expect(
+		[]string{"subscribe", "a", "1"},
+		[]string{"subscribe", "b", "2"},
+		// resubscribing doesn't count twice
+		[]string{"subscribe", "a", "2"},
+	)
+	sub.send("PSUBSCRIBE", "news.*")
+	sub.expect([]string{"psubscribe", "news.*", "3"})
+	other.send("SUBSCRIBE", "a")
+	other.expect([]string{"subscribe", "a", "1"})
+	other.send("PSUBSCRIBE", "*")
+	other.expect([]string{"psubscribe", "*", "2"})
+
+	if got := fields(pub.do("PUBSUB", "CHANNELS")); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("PUBSUB CHANNELS = %q", got)
+	}
+	if got := fields(pub.do("PUBSUB", "NUMSUB", "a", "b", "c")); !slices.Equal(got, []string{"a", "2", "b", "1", "c", "0"}) {
+		t.Errorf("PUBSUB NUMSUB = %q", got)
+	}
+	if got := pub.do("PUBSUB", "NUMPAT"); got.num != 2 {
+		t.Errorf("PUBSUB NUMPAT = %d, want 2", got.num)
+	}
+
+	// a channel reached directly and through a pattern is delivered twice
+	if got := pub.do("PUBLISH", "a", "hello"); got.num != 3 {
+		t.Errorf("PUBLISH a reached %d subscribers, want 3", got.num)
+	}
+	sub.expect([]string{"message", "a", "hello"})
+	other.expect([]string{"message", "a", "hello"}, []string{"pmessage", "*", "a", "hello"})
+
+	if got := pub.do("PUBLISH", "news.sport", "goal"); got.num != 2 {
+		t.Errorf("PUBLISH news.sport reached %d subscribers, want 2", got.num)
+	}
+	sub.expect([]string{"pmessage", "news.*", "news.sport", "goal"})
+	other.expect([]string{"pmessage", "*", "news.sport", "goal"})
+
+	// the counts include the subscriptions left of either kind
+	sub.send("UNSUBSCRIBE", "a")
+	sub.send("UNSUBSCRIBE")
+	sub.send("PUNSUBSCRIBE")
+	sub.send("UNSUBSCRIBE")
+	sub.expect(
+		[]string{"unsubscribe", "a", "2"},
+		[]string{"unsubscribe", "b", "1"},
+		[]string{"punsubscribe", "news.*", "0"},
+		[]string{"unsubscribe", "nil", "0"},
+	)
+	// an unsubscribed client is out of the subscribed context
+	if got := sub.do("GET", "k"); got.typ != NULL {
+		t.Errorf("GET after unsubscribing = %+v", got)
+	}
+	if got := pub.do("PUBLISH", "b", "gone"); got.num != 1 {
+		t.Errorf("PUBLISH b after unsubscribing reached %d subscribers, want 1", got.num)
+	}
+	other.expect([]string{"pmessage", "*", "b", "gone"})
+}
+
+func TestShardedPubSub(t *testing.T) {
+	conf := NewConfig()
+	conf.bind, conf.port = []string{"127.0.0.1"}, freePort(t)
+	listeners, state := startServer(t, conf)
+	addr := listeners[0].Addr().String()
+	sub, other, pub := dialServer(t, "tcp", addr), dialServer(t, "tcp", addr), dialServer(t, "tcp", addr)
+
+	// the hash tag puts both shard channels in the slot of foo
+	for _, ch := range []string{"foo", "{foo}a", "{foo}b"} {
+		if slot := keyHashSlot(ch); slot != 12182 {
+			t.Fatalf("%s is in slot %d, want 12182", ch, slot)
+		}
+	}
+
+	sub.send("SSUBSCRIBE", "{foo}a", "{foo}b", "bar")
+	sub.expect(
+		[]string{"ssubscribe", "{foo}a", "1"},
+		[]string{"ssubscribe", "{foo}b", "2"},
+		[]string{"ssubscribe", "bar", "3"},
+	)
+	// classic subscriptions are counted apart from shard ones
+	sub.send("SUBSCRIBE", "{foo}a")
+	sub.expect([]string{"subscribe", "{foo}a", "1"})
+	other.send("PSUBSCRIBE", "*")
+	other.expect([]string{"psubscribe", "*", "1"})
+
+	state.pubsub.mu.RLock()
+	slots := map[int][]string{}
+	for slot, channels := range state.pubsub.shards {
+		slots[slot] = slices.Sorted(maps.Keys(channels))
+	}
+	state.pubsub.mu.RUnlock()
+	want := map[int][]string{12182: {"{foo}a", "{foo}b"}, keyHashSlot("bar"): {"bar"}}
+	if !maps.EqualFunc(slots, want, slices.Equal) {
+		t.Errorf("shard channels by slot = %v, want %v", slots, want)
+	}
+
+	if got := fields(pub.do("PUBSUB", "SHARDCHANNELS")); !slices.Equal(got, []string{"bar", "{foo}a", "{foo}b"}) {
+		t.Errorf("PUBSUB SHARDCHANNELS = %q", got)
+	}
+	if got := fields(pub.do("PUBSUB", "SHARDNUMSUB", "{foo}a", "{foo}c")); !slices.Equal(got, []string{"{foo}a", "1", "{foo}c", "0"}) {
+		t.Errorf("PUBSUB SHARDNUMSUB = %q", got)
+	}
+
+	// only the channel's own subscribers get it, not others in its slot or
+	// patterns
+	if got := pub.do("SPUBLISH", "{foo}a", "hello"); got.num != 1 {
+		t.Errorf("SPUBLISH reached %d subscribers, want 1", got.num)
+	}
+	// and PUBLISH only reaches classic subscribers of the same name
+	if got := pub.do("PUBLISH", "{foo}a", "classic"); got.num != 2 {
+		t.Errorf("PUBLISH reached %d subscribers, want 2", got.num)
+	}
+	sub.expect(
+		[]string{"smessage", "{foo}a", "hello"},
+		[]string{"message", "{foo}a", "classic"},
+	)
+	other.expect([]string{"pmessage", "*", "{foo}a", "classic"})
+
+	sub.send("SUNSUBSCRIBE", "{foo}a")
+	sub.send("SUNSUBSCRIBE")
+	sub.send("SUNSUBSCRIBE")
+	sub.expect(
+		[]string{"sunsubscribe", "{foo}a", "2"},
+		[]string{"sunsubscribe", "bar", "1"},
+		[]string{"sunsubscribe", "{foo}b", "0"},
+		[]string{"sunsubscribe", "nil", "0"},
+	)
+
+	state.pubsub.mu.RLock()
+	left := len(state.pubsub.shards)
+	state.pubsub.mu.RUnlock()
+	if left != 0 {
+		t.Errorf("%d slots still hold shard channels after unsubscribing", left)
+	}
+	if got := pub.do("SPUBLISH", "{foo}b", "gone"); got.num != 0 {
+		t.Errorf("SPUBLISH after unsubscribing reached %d subscribers, want 0", got.num)
+	}
+}
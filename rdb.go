@@ -2,13 +2,14 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/gob"
-	"encoding/hex"
-	"io"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path"
+	"sync"
 	"time"
 )
 
@@ -29,7 +30,7 @@ func NewSnapshotTracker(rdb *RDBSnapshot) *SnapshotTracker {
 var trackers = []*SnapshotTracker{}
 
 func InitRDBTrackers(state *AppState) {
-	for _, rdb := range state.conf.rdb {
+	for _, rdb := range state.conf().rdb {
 		tracker := NewSnapshotTracker(&rdb)
 		trackers = append(trackers, tracker)
 
@@ -38,8 +39,10 @@ func InitRDBTrackers(state *AppState) {
 
 			for range tracker.ticker.C {
 				log.Printf("keys changed: %d - keys required to change: %d", tracker.keys, tracker.rdb.KeysChanged)
-				if tracker.keys >= tracker.rdb.KeysChanged {
+				// periodic saves are background saves, as in Redis
+				if tracker.keys >= tracker.rdb.KeysChanged && state.bgsaveRunning.CompareAndSwap(false, true) {
 					SaveRDB(state)
+					state.bgsaveRunning.Store(false)
 				}
 				tracker.keys = 0
 			}
@@ -53,90 +56,117 @@ func IncrRDBTrackers() {
 	}
 }
 
-func SaveRDB(state *AppState) {
-	fp := path.Join(state.conf.dir, state.conf.rdbFn)
-	f, err := os.OpenFile(fp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644) // owner (read-write), everyone else (read)
-	if err != nil {
-		log.Println("error opening rdb file: ", err)
-		return
-	}
-	defer f.Close()
+// rdbSaveMu serializes saves, so their files are renamed into place in the
+// order their snapshots were taken.
+var rdbSaveMu sync.Mutex
 
-	log.Println("saving DB to RDB file")
-	var buf bytes.Buffer
-	if state.bgsaveRunning {
-		err = gob.NewEncoder(&buf).Encode(&state.dbCopy)
-	} else {
-		DB.mu.RLock()
-		err = gob.NewEncoder(&buf).Encode(&DB.store)
-		DB.mu.RUnlock()
-	}
+// SaveRDB writes the dataset as it is now to the RDB file.
+func SaveRDB(state *AppState) error {
+	rdbSaveMu.Lock()
+	defer rdbSaveMu.Unlock()
 
-	if err != nil {
-		log.Println("error encoding db: ", err)
-		return
-	}
+	DB.mu.RLock()
+	snap := DB.snapshot()
+	DB.mu.RUnlock()
+	defer snap.release()
 
-	data := buf.Bytes()
+	return SaveRDBSnapshot(state, snap)
+}
 
-	bsum, err := Hash(&buf)
-	if err != nil {
-		log.Println("rdb - cannot compute buf checksum: ", err)
-		return
-	}
+// SaveRDBSnapshot writes snap to the RDB file. It's written to a temporary
+// file, fsynced and renamed over the old one, so a crash mid-save leaves the
+// last snapshot intact. The caller must hold rdbSaveMu.
+func SaveRDBSnapshot(state *AppState, snap *Snapshot) error {
+	log.Println("saving DB to RDB file")
 
-	_, err = f.Write(data)
+	conf := state.conf()
+	data := encodeRDB(snap.All(), snap.mem, conf.rdbChecksum)
+
+	fp := path.Join(conf.dir, conf.rdbFn)
+	f, err := os.CreateTemp(conf.dir, "temp-*.rdb")
 	if err != nil {
-		log.Println("rdb - cannot write to file: ", err)
-		return
+		log.Println("rdb - cannot create temp file: ", err)
+		return err
 	}
-	if err := f.Sync(); err != nil {
-		log.Println("rdb - cannot flush file to disk: ", err)
-		return
+	tmp := f.Name()
+	if err := writeFileSync(f, data); err != nil {
+		log.Println("rdb - cannot write temp file: ", err)
+		os.Remove(tmp)
+		return err
 	}
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		log.Println("rdb - cannot seek file: ", err)
-		return
+	if err := os.Rename(tmp, fp); err != nil {
+		log.Println("rdb - cannot rename temp file: ", err)
+		os.Remove(tmp)
+		return err
 	}
-
-	fsum, err := Hash(f)
-	if err != nil {
-		log.Println("rdb - cannot compute file checksum: ", err)
-		return
-	}
-
-	if bsum != fsum {
-		log.Printf("rdb - buf and file checksums do not match:\nf=%s\nb=%s\n", fsum, bsum)
-		return
+	if err := syncDir(conf.dir); err != nil {
+		log.Println("rdb - cannot fsync dir: ", err)
 	}
 
 	log.Println("saved RDB file")
 
 	state.rdbStats.rdb_last_save_ts = time.Now().Unix()
 	state.rdbStats.rdb_saves++
+	return nil
 }
 
-func SyncRDB(conf *Config) {
-	fp := path.Join(conf.dir, conf.rdbFn)
-	f, err := os.Open(fp)
-	if err != nil {
-		log.Println("error opening rdb file: ", err)
-		f.Close()
-		return
-	}
+// writeFileSync writes data to f, fsyncs and closes it.
+func writeFileSync(f *os.File, data []byte) error {
 	defer f.Close()
 
-	err = gob.NewDecoder(f).Decode(&DB.store)
-	if err != nil {
-		log.Println("error decoding rdb file: ", err)
-		return
+	// temp files are created owner only
+	if err := f.Chmod(0644); err != nil { // owner (read-write), everyone else (read)
+		return err
 	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
 }
 
-func Hash(r io.Reader) (string, error) {
-	h := sha256.New()
-	if _, err := io.Copy(h, r); err != nil {
-		return "", err
+// SyncRDB loads the RDB file into the database, keeping keys it doesn't
+// hold. A missing file is an empty dataset, but a damaged one is an error,
+// since starting without it would overwrite it on the next save. With
+// rdbchecksum no, the checksum isn't verified.
+func SyncRDB(state *AppState) error {
+	fp := path.Join(state.conf().dir, state.conf().rdbFn)
+	data, err := os.ReadFile(fp)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
+	if err != nil {
+		return fmt.Errorf("cannot read RDB file: %w", err)
+	}
+
+	var store map[string]*Item
+	// snapshots from before the RDB format were gob encoded
+	if !bytes.HasPrefix(data, []byte("REDIS")) {
+		log.Println("loading legacy gob snapshot")
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&store); err != nil {
+			return fmt.Errorf("cannot decode RDB file: %w", err)
+		}
+	} else {
+		store, err = decodeRDB(data, state.conf().rdbChecksum)
+		if err != nil {
+			return fmt.Errorf("cannot load RDB file %s: %w", fp, err)
+		}
+	}
+
+	// loaded keys are added to what's already there, replacing keys they
+	// share, as gob did when decoding into the store
+	DB.mu.Lock()
+	for k, item := range store {
+		if old, ok := DB.store[k]; ok {
+			DB.mem -= old.approxMemUsage(k)
+		}
+		DB.store[k] = item
+		DB.trackExpiry(k, item)
+		DB.mem += item.approxMemUsage(k)
+	}
+	mem := DB.mem
+	DB.mu.Unlock()
+
+	state.peakMem = max(state.peakMem, mem)
+	log.Printf("loaded %d keys from RDB file", len(store))
+	return nil
 }
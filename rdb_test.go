@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSyncRDBKeepsExistingKeys(t *testing.T) {
+	state := newTestState(t)
+	conf := NewConfig()
+	conf.dir, conf.rdbFn = t.TempDir(), "dump.rdb"
+	state.config.Store(conf)
+
+	saved := map[string]*Item{"a": {V: "from rdb"}, "b": {V: "2"}}
+	if err := os.WriteFile(path.Join(conf.dir, conf.rdbFn), encodeRDB(maps.All(saved), 0, true), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys replayed from elsewhere before the RDB file is loaded
+	DB.mu.Lock()
+	DB.Set("a", "before", state)
+	DB.Set("c", "3", state)
+	DB.mu.Unlock()
+
+	if err := SyncRDB(state); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "from rdb", "b": "2", "c": "3"}
+	var mem int64
+	for k, v := range want {
+		item, ok := DB.Peek(k)
+		if !ok || item.V != v {
+			t.Errorf("%s = %+v, want %q", k, item, v)
+			continue
+		}
+		mem += item.approxMemUsage(k)
+	}
+	if len(DB.store) != len(want) {
+		t.Errorf("%d keys loaded, want %d", len(DB.store), len(want))
+	}
+	if DB.mem != mem {
+		t.Errorf("used memory %d, want %d", DB.mem, mem)
+	}
+}
+
+func TestConcurrentSaves(t *testing.T) {
+	state := newTestState(t)
+	conf := NewConfig()
+	conf.dir, conf.rdbFn = t.TempDir(), "dump.rdb"
+	state.config.Store(conf)
+
+	DB.mu.Lock()
+	for i := range 1000 {
+		DB.Set(fmt.Sprint("k", i), strings.Repeat("v", 100), state)
+	}
+	DB.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- SaveRDB(state)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	entries, err := os.ReadDir(conf.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != conf.rdbFn {
+		t.Errorf("dir holds %v, want only %s", entries, conf.rdbFn)
+	}
+
+	data, err := os.ReadFile(path.Join(conf.dir, conf.rdbFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := decodeRDB(data, true)
+	if err != nil || len(store) != 1000 {
+		t.Errorf("saved %d keys, err %v", len(store), err)
+	}
+}
+
+func TestSaveDuringBackgroundSave(t *testing.T) {
+	state := newTestState(t)
+	c := NewReplayClient(state)
+
+	state.bgsaveRunning.Store(true)
+	if reply := save(c, commandValue("SAVE"), state); reply.typ != ERROR {
+		t.Errorf("SAVE replied %+v during a background save", reply)
+	}
+}
+
+func TestDecodeRDBSkipsOtherTypes(t *testing.T) {
+	str := func(b []byte, ss ...string) []byte {
+		for _, s := range ss {
+			b = appendRDBString(b, s)
+		}
+		return b
+	}
+	u64 := func(b []byte, n int) []byte {
+		return append(b, make([]byte, n)...)
+	}
+
+	values := []struct {
+		typ   byte
+		value func([]byte) []byte
+	}{
+		{rdbTypeList, func(b []byte) []byte { return str(appendLen(b, 2), "a", "b") }},
+		{rdbTypeSet, func(b []byte) []byte { return str(appendLen(b, 1), "a") }},
+		{rdbTypeHash, func(b []byte) []byte { return str(appendLen(b, 1), "f", "v") }},
+		{rdbTypeZset, func(b []byte) []byte {
+			b = append(str(appendLen(b, 2), "a"), 3, '1', '.', '5')
+			return append(str(b, "b"), 254)
+		}},
+		{rdbTypeZset2, func(b []byte) []byte { return u64(str(appendLen(b, 1), "a"), 8) }},
+		{rdbTypeSetIntset, func(b []byte) []byte { return str(b, "encoded") }},
+		{rdbTypeHashListpack, func(b []byte) []byte { return str(b, "encoded") }},
+		{rdbTypeListQuicklist, func(b []byte) []byte { return str(appendLen(b, 1), "ziplist") }},
+		{rdbTypeListQuicklist2, func(b []byte) []byte { return str(appendLen(appendLen(b, 1), 2), "listpack") }},
+		{rdbTypeHashListpackEx, func(b []byte) []byte { return str(u64(b, 8), "listpack") }},
+		{rdbTypeHashMetadata, func(b []byte) []byte { return str(appendLen(appendLen(u64(b, 8), 1), 0), "f", "v") }},
+		{rdbTypeModule2, func(b []byte) []byte {
+			b = appendLen(appendLen(b, 1234), rdbModuleSInt)
+			b = appendLen(appendLen(b, 7), rdbModuleDouble)
+			b = appendLen(u64(b, 8), rdbModuleString)
+			return appendLen(str(b, "state"), rdbModuleEOF)
+		}},
+		{rdbTypeStreamListpacks, func(b []byte) []byte {
+			b = str(appendLen(b, 1), "master id", "listpack")
+			// length, last ID, one group with one pending entry and consumer
+			b = appendLen(appendLen(appendLen(b, 1), 1), 0)
+			b = appendLen(appendLen(appendLen(str(appendLen(b, 1), "group"), 1), 0), 1)
+			b = appendLen(u64(b, 16+8), 1)
+			b = u64(str(appendLen(b, 1), "consumer"), 8)
+			return u64(appendLen(b, 1), 16)
+		}},
+		{rdbTypeStreamListpacks3, func(b []byte) []byte {
+			b = str(appendLen(b, 0))
+			b = appendLen(appendLen(appendLen(appendLen(b, 0), 0), 0), 0)
+			b = appendLen(appendLen(appendLen(appendLen(b, 0), 0), 0), 0)
+			// one group with entries read, and a consumer with an active time
+			b = appendLen(appendLen(appendLen(str(appendLen(b, 1), "group"), 0), 0), 0)
+			b = appendLen(b, 0)
+			b = u64(str(appendLen(b, 1), "consumer"), 16)
+			return appendLen(b, 0)
+		}},
+	}
+
+	b := fmt.Appendf(nil, "REDIS%04d", 12)
+	b = append(b, rdbOpModuleAux)
+	b = appendLen(appendLen(appendLen(b, 1234), 2), 1)
+	b = appendLen(str(appendLen(b, rdbModuleString), "aux"), rdbModuleEOF)
+	b = append(b, rdbOpSelectDB)
+	b = appendLen(b, 0)
+
+	want := map[string]string{}
+	for i, v := range values {
+		b = append(b, v.typ)
+		b = v.value(str(b, fmt.Sprint("other", i)))
+		// a key after each skipped one is still loaded
+		k := fmt.Sprint("string", i)
+		b = str(append(b, rdbTypeString), k, "v")
+		want[k] = "v"
+	}
+	b = append(b, rdbOpEOF)
+	b = u64(b, 8)
+
+	store, err := decodeRDB(b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range want {
+		if item, ok := store[k]; !ok || item.V != v {
+			t.Errorf("%s = %+v, want %q", k, item, v)
+		}
+	}
+	if len(store) != len(want) {
+		t.Errorf("%d keys loaded, want %d", len(store), len(want))
+	}
+
+	// a type nobody writes is still an error
+	b = fmt.Appendf(nil, "REDIS%04d", 12)
+	b = str(append(b, 100), "k", "v")
+	if _, err := decodeRDB(b, true); err == nil {
+		t.Error("loaded an RDB file with an unknown type")
+	}
+}
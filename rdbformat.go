@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"log"
+	"strconv"
+	"time"
+)
+
+// RDB_VERSION is the version written to RDB files. Version 9 is the oldest
+// with every opcode we write, so the files load on Redis 5.0 and later.
+const RDB_VERSION = 9
+
+// rdbMaxVersion is the newest version we load, that of Redis 7.4
+const rdbMaxVersion = 12
+
+const (
+	rdbTypeString byte = 0
+
+	// types we can't hold, which are skipped when loading a dump from Redis
+	rdbTypeList             byte = 1
+	rdbTypeSet              byte = 2
+	rdbTypeZset             byte = 3
+	rdbTypeHash             byte = 4
+	rdbTypeZset2            byte = 5
+	rdbTypeModule2          byte = 7
+	rdbTypeHashZipmap       byte = 9
+	rdbTypeListZiplist      byte = 10
+	rdbTypeSetIntset        byte = 11
+	rdbTypeZsetZiplist      byte = 12
+	rdbTypeHashZiplist      byte = 13
+	rdbTypeListQuicklist    byte = 14
+	rdbTypeStreamListpacks  byte = 15
+	rdbTypeHashListpack     byte = 16
+	rdbTypeZsetListpack     byte = 17
+	rdbTypeListQuicklist2   byte = 18
+	rdbTypeStreamListpacks2 byte = 19
+	rdbTypeSetListpack      byte = 20
+	rdbTypeStreamListpacks3 byte = 21
+	rdbTypeHashMetadata     byte = 24
+	rdbTypeHashListpackEx   byte = 25
+
+	rdbOpSlotInfo  byte = 0xf4
+	rdbOpFunction2 byte = 0xf5
+	rdbOpModuleAux byte = 0xf7
+	rdbOpIdle      byte = 0xf8
+	rdbOpFreq      byte = 0xf9
+	rdbOpAux       byte = 0xfa
+	rdbOpResizeDB  byte = 0xfb
+	rdbOpExpireMs  byte = 0xfc
+	rdbOpExpire    byte = 0xfd
+	rdbOpSelectDB  byte = 0xfe
+	rdbOpEOF       byte = 0xff
+)
+
+// special string encodings, flagged by a length whose top two bits are set
+const (
+	rdbEncInt8  byte = 0
+	rdbEncInt16 byte = 1
+	rdbEncInt32 byte = 2
+	rdbEncLZF   byte = 3
+)
+
+// rdbCompressAbove is the length from which strings are LZF compressed
+const rdbCompressAbove = 20
+
+// encodeRDB serializes store as an RDB file:
+//
+//	"REDIS" version | aux fields | SELECTDB 0 | RESIZEDB | keys | EOF | crc64
+//
+// Each key is an optional expiry, idle time and access count, then the value
+// type, the key and the value. Expired keys are left out. Without checksum
+// the trailer is 0, which loaders take as no checksum.
+func encodeRDB(items iter.Seq2[string, *Item], usedMem int64, checksum bool) []byte {
+	// the keys are read once, so they're encoded before the RESIZEDB that
+	// counts them
+	var body []byte
+	var keys, expires uint64
+	now := time.Now()
+	for k, item := range items {
+		if item.shouldExpire() {
+			continue
+		}
+
+		keys++
+		if item.Exp.Unix() != UNIX_TS_EPOCH {
+			expires++
+			body = append(body, rdbOpExpireMs)
+			body = binary.LittleEndian.AppendUint64(body, uint64(item.Exp.UnixMilli()))
+		}
+		if !item.LastAccess.IsZero() {
+			body = append(body, rdbOpIdle)
+			body = appendLen(body, uint64(max(now.Sub(item.LastAccess).Seconds(), 0)))
+		}
+		if item.Accesses > 0 {
+			body = append(body, rdbOpFreq, byte(min(item.Accesses, 255)))
+		}
+
+		body = append(body, rdbTypeString)
+		body = appendRDBString(body, k)
+		body = appendRDBString(body, item.V)
+	}
+
+	b := fmt.Appendf(nil, "REDIS%04d", RDB_VERSION)
+
+	aux := func(k, v string) {
+		b = append(b, rdbOpAux)
+		b = appendRDBString(b, k)
+		b = appendRDBString(b, v)
+	}
+	aux("redis-ver", REDIS_VERSION)
+	aux("redis-bits", "64")
+	aux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	aux("used-mem", strconv.FormatInt(usedMem, 10))
+	aux("aof-base", "0")
+
+	b = append(b, rdbOpSelectDB)
+	b = appendLen(b, 0)
+	b = append(b, rdbOpResizeDB)
+	b = appendLen(b, keys)
+	b = appendLen(b, expires)
+	b = append(b, body...)
+
+	b = append(b, rdbOpEOF)
+	if !checksum {
+		return binary.LittleEndian.AppendUint64(b, 0)
+	}
+	return binary.LittleEndian.AppendUint64(b, crc64(0, b))
+}
+
+// appendRDBString writes s as an integer if it's the canonical form of one
+// that fits in 32 bits, LZF compressed if that saves space, or as is.
+func appendRDBString(b []byte, s string) []byte {
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(n, 10) == s {
+			switch {
+			case n >= -1<<7 && n < 1<<7:
+				return append(b, 0xc0|rdbEncInt8, byte(n))
+			case n >= -1<<15 && n < 1<<15:
+				b = append(b, 0xc0|rdbEncInt16)
+				return binary.LittleEndian.AppendUint16(b, uint16(n))
+			default:
+				b = append(b, 0xc0|rdbEncInt32)
+				return binary.LittleEndian.AppendUint32(b, uint32(n))
+			}
+		}
+	}
+
+	if len(s) > rdbCompressAbove {
+		if c := lzfCompress([]byte(s), len(s)-4); c != nil {
+			b = append(b, 0xc0|rdbEncLZF)
+			b = appendLen(b, uint64(len(c)))
+			b = appendLen(b, uint64(len(s)))
+			return append(b, c...)
+		}
+	}
+
+	b = appendLen(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+var errRDBFormat = errors.New("bad RDB format")
+
+// rdbParser reads an RDB file held in memory.
+type rdbParser struct {
+	b   []byte
+	pos int
+}
+
+func (p *rdbParser) byte() (byte, error) {
+	if p.pos >= len(p.b) {
+		return 0, errRDBFormat
+	}
+	p.pos++
+	return p.b[p.pos-1], nil
+}
+
+func (p *rdbParser) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(p.b)-p.pos) {
+		return nil, errRDBFormat
+	}
+	p.pos += int(n)
+	return p.b[p.pos-int(n) : p.pos], nil
+}
+
+func (p *rdbParser) len() (uint64, error) {
+	n, size, err := readLen(p.b[p.pos:])
+	if err != nil {
+		return 0, errRDBFormat
+	}
+	p.pos += size
+	return n, nil
+}
+
+func (p *rdbParser) string() (string, error) {
+	if p.pos >= len(p.b) {
+		return "", errRDBFormat
+	}
+	if p.b[p.pos]>>6 != 3 {
+		n, err := p.len()
+		if err != nil {
+			return "", err
+		}
+		s, err := p.bytes(n)
+		return string(s), err
+	}
+
+	enc := p.b[p.pos] & 0x3f
+	p.pos++
+	switch enc {
+	case rdbEncInt8:
+		b, err := p.bytes(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case rdbEncInt16:
+		b, err := p.bytes(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case rdbEncInt32:
+		b, err := p.bytes(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case rdbEncLZF:
+		clen, err := p.len()
+		if err != nil {
+			return "", err
+		}
+		size, err := p.len()
+		if err != nil {
+			return "", err
+		}
+		c, err := p.bytes(clen)
+		if err != nil {
+			return "", err
+		}
+		if size > uint64(PROTO_MAX_BULK_LEN) {
+			return "", errRDBFormat
+		}
+		s, err := lzfDecompress(c, int(size))
+		return string(s), err
+	}
+
+	return "", fmt.Errorf("unknown RDB string encoding %d", enc)
+}
+
+// module values are a sequence of typed fields, ended by rdbModuleEOF
+const (
+	rdbModuleEOF    = 0
+	rdbModuleSInt   = 1
+	rdbModuleUInt   = 2
+	rdbModuleFloat  = 3
+	rdbModuleDouble = 4
+	rdbModuleString = 5
+)
+
+// skipStrings skips a length followed by that many groups of n strings.
+func (p *rdbParser) skipStrings(n int) error {
+	count, err := p.len()
+	if err != nil {
+		return err
+	}
+	for range count {
+		for range n {
+			if _, err := p.string(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skipDouble skips a sorted set score in the old string form, where a length
+// of 253, 254 or 255 stands for nan, inf and -inf.
+func (p *rdbParser) skipDouble() error {
+	n, err := p.byte()
+	if err != nil {
+		return err
+	}
+	if n < 253 {
+		_, err = p.bytes(uint64(n))
+	}
+	return err
+}
+
+// skipLens skips n lengths.
+func (p *rdbParser) skipLens(n int) error {
+	for range n {
+		if _, err := p.len(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *rdbParser) skipModuleValue() error {
+	for {
+		op, err := p.len()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case rdbModuleEOF:
+			return nil
+		case rdbModuleSInt, rdbModuleUInt:
+			_, err = p.len()
+		case rdbModuleFloat:
+			_, err = p.bytes(4)
+		case rdbModuleDouble:
+			_, err = p.bytes(8)
+		case rdbModuleString:
+			_, err = p.string()
+		default:
+			return fmt.Errorf("unknown RDB module opcode %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *rdbParser) skipStream(typ byte) error {
+	// the entries, as listpacks keyed by their master ID
+	if err := p.skipStrings(2); err != nil {
+		return err
+	}
+	// length and last ID, then first ID, max deleted ID and entries added
+	lens := 3
+	if typ >= rdbTypeStreamListpacks2 {
+		lens += 5
+	}
+	if err := p.skipLens(lens); err != nil {
+		return err
+	}
+
+	groups, err := p.len()
+	if err != nil {
+		return err
+	}
+	for range groups {
+		if _, err := p.string(); err != nil {
+			return err
+		}
+		// last delivered ID, then entries read
+		lens := 2
+		if typ >= rdbTypeStreamListpacks2 {
+			lens++
+		}
+		if err := p.skipLens(lens); err != nil {
+			return err
+		}
+
+		// pending entries: ID, delivery time and delivery count
+		pending, err := p.len()
+		if err != nil {
+			return err
+		}
+		for range pending {
+			if _, err := p.bytes(16 + 8); err != nil {
+				return err
+			}
+			if _, err := p.len(); err != nil {
+				return err
+			}
+		}
+
+		consumers, err := p.len()
+		if err != nil {
+			return err
+		}
+		for range consumers {
+			if _, err := p.string(); err != nil {
+				return err
+			}
+			// seen time, then active time
+			times := uint64(8)
+			if typ >= rdbTypeStreamListpacks3 {
+				times += 8
+			}
+			if _, err := p.bytes(times); err != nil {
+				return err
+			}
+
+			// the IDs of the consumer's pending entries
+			pending, err := p.len()
+			if err != nil {
+				return err
+			}
+			for range pending {
+				if _, err := p.bytes(16); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// skipValue skips the key and value of a type we can't hold, such as the
+// lists, sets, hashes and streams in a dump from Redis.
+func (p *rdbParser) skipValue(typ byte) error {
+	if _, err := p.string(); err != nil {
+		return err
+	}
+
+	switch typ {
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
+		return p.skipStrings(1)
+	case rdbTypeHash:
+		return p.skipStrings(2)
+	case rdbTypeZset, rdbTypeZset2:
+		n, err := p.len()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if _, err := p.string(); err != nil {
+				return err
+			}
+			if typ == rdbTypeZset {
+				err = p.skipDouble()
+			} else {
+				_, err = p.bytes(8)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZsetZiplist,
+		rdbTypeHashZiplist, rdbTypeHashListpack, rdbTypeZsetListpack, rdbTypeSetListpack:
+		// encoded as a single string
+		_, err := p.string()
+		return err
+	case rdbTypeListQuicklist2:
+		// each node is its container type, then the node as a string
+		n, err := p.len()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if _, err := p.len(); err != nil {
+				return err
+			}
+			if _, err := p.string(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeHashListpackEx:
+		// the earliest field expiry, then the listpack
+		if _, err := p.bytes(8); err != nil {
+			return err
+		}
+		_, err := p.string()
+		return err
+	case rdbTypeHashMetadata:
+		// the earliest field expiry, then each field's TTL, name and value
+		if _, err := p.bytes(8); err != nil {
+			return err
+		}
+		n, err := p.len()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if _, err := p.len(); err != nil {
+				return err
+			}
+			for range 2 {
+				if _, err := p.string(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case rdbTypeModule2:
+		if _, err := p.len(); err != nil {
+			return err
+		}
+		return p.skipModuleValue()
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return p.skipStream(typ)
+	}
+
+	return fmt.Errorf("unsupported RDB type %d", typ)
+}
+
+// decodeRDB loads an RDB file written by us or by Redis. Only the first
+// database is kept, as it's the only one we have, and expired keys are
+// dropped. Keys of types we can't hold are skipped and logged, as are module
+// aux fields. verify checks the checksum, if the file has one.
+func decodeRDB(b []byte, verify bool) (map[string]*Item, error) {
+	if len(b) < 9 || !bytes.HasPrefix(b, []byte("REDIS")) {
+		return nil, errors.New("not an RDB file")
+	}
+	version, err := strconv.Atoi(string(b[5:9]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return nil, fmt.Errorf("unsupported RDB version %s", b[5:9])
+	}
+
+	p := rdbParser{b: b, pos: 9}
+	store := map[string]*Item{}
+	db := uint64(0)
+	item := &Item{}
+	// keys skipped by type
+	skipped := map[byte]int{}
+
+	for {
+		op, err := p.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case rdbOpEOF:
+			// versions 5 and up end with a checksum, where 0 means none
+			if version >= 5 {
+				sum, err := p.bytes(8)
+				if err != nil {
+					return nil, err
+				}
+				want := binary.LittleEndian.Uint64(sum)
+				if verify && want != 0 && want != crc64(0, b[:p.pos-8]) {
+					return nil, errors.New("RDB checksum mismatch, set rdbchecksum no to load it anyway")
+				}
+			}
+			for typ, n := range skipped {
+				log.Printf("skipped %d keys of RDB type %d, which can't be held", n, typ)
+			}
+			return store, nil
+		case rdbOpAux:
+			if _, err := p.string(); err != nil {
+				return nil, err
+			}
+			if _, err := p.string(); err != nil {
+				return nil, err
+			}
+		case rdbOpSelectDB:
+			if db, err = p.len(); err != nil {
+				return nil, err
+			}
+		case rdbOpResizeDB:
+			size, err := p.len()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.len(); err != nil {
+				return nil, err
+			}
+			if db == 0 && len(store) == 0 && size < 1<<24 {
+				store = make(map[string]*Item, size)
+			}
+		case rdbOpSlotInfo:
+			for range 3 {
+				if _, err := p.len(); err != nil {
+					return nil, err
+				}
+			}
+		case rdbOpFunction2:
+			if _, err := p.string(); err != nil {
+				return nil, err
+			}
+		case rdbOpModuleAux:
+			// module ID, then when the aux field was saved, as a UINT
+			if err := p.skipLens(3); err != nil {
+				return nil, err
+			}
+			if err := p.skipModuleValue(); err != nil {
+				return nil, err
+			}
+			log.Println("skipped an RDB module aux field")
+		case rdbOpExpireMs:
+			ms, err := p.bytes(8)
+			if err != nil {
+				return nil, err
+			}
+			item.Exp = time.UnixMilli(int64(binary.LittleEndian.Uint64(ms)))
+		case rdbOpExpire:
+			secs, err := p.bytes(4)
+			if err != nil {
+				return nil, err
+			}
+			item.Exp = time.Unix(int64(binary.LittleEndian.Uint32(secs)), 0)
+		case rdbOpIdle:
+			idle, err := p.len()
+			if err != nil {
+				return nil, err
+			}
+			item.LastAccess = time.Now().Add(-time.Duration(idle) * time.Second)
+		case rdbOpFreq:
+			freq, err := p.byte()
+			if err != nil {
+				return nil, err
+			}
+			item.Accesses = int(freq)
+		case rdbTypeString:
+			k, err := p.string()
+			if err != nil {
+				return nil, err
+			}
+			if item.V, err = p.string(); err != nil {
+				return nil, err
+			}
+
+			if db == 0 && !item.shouldExpire() {
+				store[k] = item
+			}
+			item = &Item{}
+		default:
+			offset := p.pos - 1
+			if err := p.skipValue(op); err != nil {
+				return nil, fmt.Errorf("%w at offset %d", err, offset)
+			}
+			skipped[op]++
+			item = &Item{}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "strings"
+
+const clusterSlots = 16384
+
+// crc16 is the CRC-16/XMODEM checksum Redis Cluster uses to map keys to slots.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keyHashSlot returns the hash slot for a key or shard channel. If the name
+// contains a non-empty {hashtag}, only the tag is hashed.
+func keyHashSlot(k string) int {
+	if start := strings.IndexByte(k, '{'); start >= 0 {
+		if end := strings.IndexByte(k[start+1:], '}'); end > 0 {
+			k = k[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(k)) % clusterSlots
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"iter"
+	"slices"
+	"time"
+)
+
+// snapshotChunk is how many keys a snapshot copies per read lock, so writers
+// are only held off briefly while it's read.
+const snapshotChunk = 1024
+
+// Snapshot is a point-in-time view of the database, taken without copying
+// it. Until it's released, writers save the old version of each key they
+// change into the snapshot first, so it always reads the keys as they were
+// when it was taken, however long it takes to read.
+type Snapshot struct {
+	db    *Database
+	store map[string]*Item
+	gen   uint64
+	// saved holds the version at snapshot time of every key changed since,
+	// or nil for keys that didn't exist then
+	saved map[string]*Item
+	mem   int64
+	Time  time.Time
+}
+
+// snapshot takes a snapshot. The caller must hold at least a read lock, and
+// release the snapshot when done.
+func (db *Database) snapshot() *Snapshot {
+	s := &Snapshot{
+		db:    db,
+		store: db.store,
+		gen:   db.gen,
+		saved: map[string]*Item{},
+		mem:   db.mem,
+		Time:  time.Now(),
+	}
+
+	// readers may take snapshots concurrently
+	db.snapMu.Lock()
+	db.snapshots = append(db.snapshots, s)
+	db.snapMu.Unlock()
+
+	return s
+}
+
+// release stops the snapshot from tracking writes.
+func (s *Snapshot) release() {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	s.db.snapMu.Lock()
+	s.db.snapshots = slices.DeleteFunc(s.db.snapshots, func(other *Snapshot) bool { return other == s })
+	s.db.snapMu.Unlock()
+}
+
+// beforeWrite must be called before key k is changed in any way, including
+// its access stats, to save its current version into active snapshots. The
+// caller must hold the write lock.
+func (db *Database) beforeWrite(k string) {
+	for _, s := range db.snapshots {
+		// a flush replaced the store the snapshot reads, so it no longer
+		// changes under it
+		if s.gen != db.gen {
+			continue
+		}
+		if _, ok := s.saved[k]; ok {
+			continue
+		}
+
+		var pre *Item
+		if item, ok := db.store[k]; ok {
+			dup := *item
+			pre = &dup
+		}
+		s.saved[k] = pre
+	}
+}
+
+// replace swaps in a new store, such as an empty one for FLUSHDB. Snapshots
+// keep reading the old one, which nothing changes any more. The caller must
+// hold the write lock.
+func (db *Database) replace(store map[string]*Item) {
+	db.store = store
+	db.gen++
+
+	db.mem = 0
+	db.expires = map[string]struct{}{}
+	for k, item := range store {
+		db.mem += item.approxMemUsage(k)
+		db.trackExpiry(k, item)
+	}
+}
+
+// All returns copies of the keys as they were when the snapshot was taken.
+// Keys that had expired by then are included, as in the store.
+func (s *Snapshot) All() iter.Seq2[string, *Item] {
+	return func(yield func(string, *Item) bool) {
+		type entry struct {
+			k    string
+			item Item
+		}
+		batch := make([]entry, 0, snapshotChunk)
+
+		// copies are made under the lock and yielded outside it. The map
+		// may change while the lock is released, which iteration allows:
+		// keys saved before they were reached come from saved instead.
+		flush := func() bool {
+			s.db.mu.RUnlock()
+			defer s.db.mu.RLock()
+			for _, e := range batch {
+				if !yield(e.k, &e.item) {
+					return false
+				}
+			}
+			batch = batch[:0]
+			return true
+		}
+
+		s.db.mu.RLock()
+		// every key read from the store, so ones deleted after they were
+		// read aren't read again from saved
+		seen := make(map[string]struct{}, len(s.store))
+		for k, item := range s.store {
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+
+			if pre, ok := s.saved[k]; !ok {
+				batch = append(batch, entry{k, *item})
+			} else if pre != nil {
+				batch = append(batch, entry{k, *pre})
+			}
+
+			if len(batch) == snapshotChunk && !flush() {
+				s.db.mu.RUnlock()
+				return
+			}
+		}
+
+		// keys deleted before the iteration reached them
+		for k, pre := range s.saved {
+			if _, ok := seen[k]; pre != nil && !ok {
+				batch = append(batch, entry{k, *pre})
+			}
+		}
+		s.db.mu.RUnlock()
+
+		for _, e := range batch {
+			if !yield(e.k, &e.item) {
+				return
+			}
+		}
+	}
+}
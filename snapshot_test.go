@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotUnderWrites(t *testing.T) {
+	state := newTestState(t)
+
+	const n = 5000
+	DB.mu.Lock()
+	for i := range n {
+		DB.Set(fmt.Sprint("k", i), fmt.Sprint("v", i), state)
+	}
+	DB.mu.Unlock()
+
+	DB.mu.RLock()
+	snap := DB.snapshot()
+	DB.mu.RUnlock()
+
+	// sets, deletes, reads that update access stats, and flushes, while the
+	// snapshot is read
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				k := fmt.Sprint("k", (i*7+w)%(n+1000))
+				switch i % 4 {
+				case 0:
+					DB.mu.Lock()
+					DB.Delete(k, state)
+					DB.mu.Unlock()
+				case 1:
+					DB.mu.Lock()
+					DB.Set(k, "changed", state)
+					DB.mu.Unlock()
+				case 2:
+					DB.Get(k, state)
+				case 3:
+					if i%1000 == 3 {
+						DB.mu.Lock()
+						DB.replace(map[string]*Item{})
+						DB.mu.Unlock()
+					}
+				}
+			}
+		}()
+	}
+
+	got := map[string]string{}
+	for k, item := range snap.All() {
+		if _, ok := got[k]; ok {
+			t.Errorf("%s read twice", k)
+		}
+		if item.Accesses != 0 {
+			t.Errorf("%s read with %d accesses made after the snapshot", k, item.Accesses)
+		}
+		got[k] = item.V
+	}
+	close(stop)
+	wg.Wait()
+	snap.release()
+
+	if len(got) != n {
+		t.Errorf("read %d keys, want %d", len(got), n)
+	}
+	for i := range n {
+		if k := fmt.Sprint("k", i); got[k] != fmt.Sprint("v", i) {
+			t.Errorf("%s = %q, want %q", k, got[k], fmt.Sprint("v", i))
+		}
+	}
+	if len(DB.snapshots) != 0 {
+		t.Errorf("%d snapshots left after release", len(DB.snapshots))
+	}
+}
+
+func TestBackgroundSaveStartsOnce(t *testing.T) {
+	state := newTestState(t)
+	conf := NewConfig()
+	conf.dir, conf.rdbFn = t.TempDir(), "dump.rdb"
+	state.config.Store(conf)
+	c := NewReplayClient(state)
+
+	// hold saves back so every BGSAVE overlaps the first
+	rdbSaveMu.Lock()
+
+	var started atomic.Int32
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reply := bgsave(c, commandValue("BGSAVE"), state); reply.typ == STRING {
+				started.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	rdbSaveMu.Unlock()
+
+	if n := started.Load(); n != 1 {
+		t.Errorf("%d background saves started, want 1", n)
+	}
+	for state.bgsaveRunning.Load() {
+		time.Sleep(time.Millisecond)
+	}
+}
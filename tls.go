@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// TLS_HANDSHAKE_TIMEOUT bounds how long a client may take to complete the
+// handshake before it's disconnected
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+type TLSAuthClients string
+
+const (
+	TLSAuthYes      TLSAuthClients = "yes"
+	TLSAuthNo       TLSAuthClients = "no"
+	TLSAuthOptional TLSAuthClients = "optional"
+)
+
+func loadTLSConfig(conf *Config) (*tls.Config, error) {
+	if conf.tlsCertFile == "" || conf.tlsKeyFile == "" {
+		return nil, errors.New("tls-port requires tls-cert-file and tls-key-file")
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.tlsCertFile, conf.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch conf.tlsAuthClients {
+	case TLSAuthNo:
+		tlsConf.ClientAuth = tls.NoClientCert
+		return tlsConf, nil
+	case TLSAuthOptional:
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if conf.tlsCACertFile == "" {
+		return nil, errors.New("tls-auth-clients requires tls-ca-cert-file")
+	}
+
+	pem, err := os.ReadFile(conf.tlsCACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", conf.tlsCACertFile)
+	}
+	tlsConf.ClientCAs = pool
+
+	return tlsConf, nil
+}
+
+// tlsHandshake completes the handshake up front, so the client certificate
+// is known before any command runs. It returns the certificate's common
+// name, or "" if the client didn't present one.
+func tlsHandshake(conn *tls.Conn) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TLS_HANDSHAKE_TIMEOUT)
+	defer cancel()
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return "", err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", nil
+	}
+	return certs[0].Subject.CommonName, nil
+}
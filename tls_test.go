@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for cn signed by the CA, as PEM encoded
+// certificate and key.
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) (certPEM []byte, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) clientCert(t *testing.T, cn string) *tls.Certificate {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, cn, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startTLSServer serves conf's TLS port with a certificate from ca, and
+// returns its address.
+func startTLSServer(t *testing.T, ca *testCA, conf *Config) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	conf.tlsCertFile = path.Join(dir, "server.crt")
+	conf.tlsKeyFile = path.Join(dir, "server.key")
+	conf.tlsCACertFile = path.Join(dir, "ca.crt")
+	for fp, data := range map[string][]byte{conf.tlsCertFile: certPEM, conf.tlsKeyFile: keyPEM, conf.tlsCACertFile: ca.pem} {
+		if err := os.WriteFile(fp, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf.bind = []string{"127.0.0.1"}
+	conf.port = 0
+	conf.tlsPort = freePort(t)
+
+	listeners, _ := startServer(t, conf)
+	return listeners[0].Addr().String()
+}
+
+// startServer serves every listener conf asks for on a fresh database, and
+// returns them with the server's state.
+func startServer(t *testing.T, conf *Config) ([]net.Listener, *AppState) {
+	t.Helper()
+
+	listeners, err := listen(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeListeners(listeners) })
+
+	DB = NewDatabase()
+	state, err := NewAppState(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range listeners {
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go handleConn(conn, state)
+			}
+		}()
+	}
+
+	return listeners, state
+}
+
+// testConn is a RESP2 client of a test server.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	w    *Writer
+	r    *bufio.Reader
+}
+
+func dialServer(t *testing.T, network string, addr string) *testConn {
+	t.Helper()
+
+	conn, err := net.DialTimeout(network, addr, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, w: NewWriter(conn), r: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply.
+func (c *testConn) do(args ...string) Value {
+	c.t.Helper()
+
+	c.send(args...)
+	return c.next()
+}
+
+// send sends a command without waiting for its reply.
+func (c *testConn) send(args ...string) {
+	c.t.Helper()
+
+	c.w.Write(commandValue(args...))
+	if err := c.w.Flush(); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next reads the next reply, or message for subscribers.
+func (c *testConn) next() Value {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	v := Value{}
+	if err := v.read(c.r, PROTO_MAX_BULK_LEN); err != nil {
+		c.t.Fatal(err)
+	}
+	return v
+}
+
+// tlsCommand sends an inline command over TLS and returns the reply line.
+func tlsCommand(addr string, ca *testCA, cert *tls.Certificate, cmd string) (string, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tlsConf := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		tlsConf.Certificates = []tls.Certificate{*cert}
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", addr, tlsConf)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// with TLS 1.3 a rejected certificate only shows up on the first read
+	if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	return strings.TrimSuffix(line, "\r\n"), err
+}
+
+func TestTLSAuthClients(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+
+	tests := []struct {
+		auth     TLSAuthClients
+		cert     *tls.Certificate
+		accepted bool
+	}{
+		{TLSAuthYes, ca.clientCert(t, "alice"), true},
+		{TLSAuthYes, nil, false},
+		{TLSAuthYes, other.clientCert(t, "mallory"), false},
+		{TLSAuthOptional, ca.clientCert(t, "alice"), true},
+		{TLSAuthOptional, nil, true},
+		{TLSAuthOptional, other.clientCert(t, "mallory"), false},
+		{TLSAuthNo, nil, true},
+	}
+
+	for _, tt := range tests {
+		conf := NewConfig()
+		conf.tlsAuthClients = tt.auth
+		addr := startTLSServer(t, ca, conf)
+
+		reply, err := tlsCommand(addr, ca, tt.cert, "PING")
+		accepted := err == nil && reply == "+PONG"
+		if accepted != tt.accepted {
+			cn := "none"
+			if tt.cert != nil {
+				cn = tt.cert.Leaf.Subject.CommonName
+			}
+			t.Errorf("tls-auth-clients %s with certificate %s: reply %q, err %v", tt.auth, cn, reply, err)
+		}
+	}
+}
+
+func TestTLSAuthClientsUserCN(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.clientCert(t, "alice")
+
+	for _, user := range []string{"CN", "off"} {
+		conf := NewConfig()
+		conf.requirepass, conf.password = true, "secret"
+		conf.tlsAuthClientsUser = user
+		addr := startTLSServer(t, ca, conf)
+
+		// only a certificate mapped to a user authenticates the client
+		want := "$-1"
+		if user == "off" {
+			want = "-NOAUTH authentication required"
+		}
+		if reply, err := tlsCommand(addr, ca, cert, "GET k"); err != nil || reply != want {
+			t.Errorf("tls-auth-clients-user %s: reply %q, err %v, want %q", user, reply, err, want)
+		}
+	}
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"strconv"
 	"strings"
 )
@@ -18,15 +19,24 @@ const (
 	INTEGER ValueType = ":"
 	ERROR   ValueType = "-"
 	NULL    ValueType = ""
+
+	// RESP3 only. Writers downgrade them for RESP2 connections.
+	MAP    ValueType = "%"
+	DOUBLE ValueType = ","
+	PUSH   ValueType = ">"
 )
 
 type Value struct {
-	typ   ValueType
-	bulk  string
-	str   string
-	num   int
-	err   string
-	array []Value
+	typ    ValueType
+	bulk   string
+	str    string
+	num    int
+	err    string
+	array  []Value // MAP holds alternating keys and values
+	double float64
+	// stream, when set, writes the value in place of the fields above, so
+	// large replies can be written element by element
+	stream func(w *Writer)
 }
 
 func readLine(r *bufio.Reader) (string, error) {
@@ -37,26 +47,111 @@ func readLine(r *bufio.Reader) (string, error) {
 	return strings.TrimSuffix(line, "\r\n"), nil
 }
 
-func (v *Value) readArray(r *bufio.Reader) error {
-	line, err := readLine(r)
-	if err != nil {
-		return err
+const (
+	// PROTO_INLINE_MAX_SIZE bounds inline requests and the header lines of
+	// multibulk requests, which have no length prefix of their own
+	PROTO_INLINE_MAX_SIZE = 64 * 1024
+	// PROTO_MAX_MULTIBULK_LEN bounds the number of arguments in a request
+	PROTO_MAX_MULTIBULK_LEN = 1024 * 1024
+	// PROTO_MAX_BULK_LEN is the default for proto-max-bulk-len
+	PROTO_MAX_BULK_LEN = 512 * 1024 * 1024
+	// bulks larger than this grow their buffer as data arrives, instead of
+	// trusting the client's length up front
+	protoBulkPrealloc = 64 * 1024
+)
+
+// ProtocolError is returned for malformed requests. The client is sent the
+// error and disconnected, as the rest of its stream can't be trusted.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readRequestLine reads a line of at most max bytes, without buffering more
+// than that for clients that never send a newline.
+func readRequestLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > max {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
 	}
 
-	if line[0] != '*' {
-		return errors.New("expected array")
+	// inline requests from netcat end with a bare \n
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// parseProtoInt parses a length the way Redis does: an optional minus sign
+// followed by digits, with no leading zeros, spaces or plus sign.
+func parseProtoInt(s string) (int64, bool) {
+	digits := strings.TrimPrefix(s, "-")
+	if len(digits) == 0 || len(digits) > 18 || (len(digits) > 1 && digits[0] == '0') {
+		return 0, false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, false
+		}
 	}
 
-	arrLen, err := strconv.Atoi(line[1:])
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// readArray reads a request, either a RESP array of bulk strings or an inline
+// command typed by hand. Every frame is validated, and a malformed one
+// returns a *ProtocolError instead of a partial request. Empty requests
+// leave v.array empty.
+func (v *Value) readArray(r *bufio.Reader, maxBulkLen int64) error {
+	line, err := readRequestLine(r, PROTO_INLINE_MAX_SIZE)
+	if err == errLineTooLong {
+		return &ProtocolError{msg: "too big inline request"}
+	}
 	if err != nil {
 		return err
 	}
 
+	if len(line) == 0 || line[0] != '*' {
+		args, err := splitInlineArgs(line)
+		if err != nil {
+			return err
+		}
+		for _, arg := range args {
+			v.array = append(v.array, Value{typ: BULK, bulk: arg})
+		}
+		return nil
+	}
+
+	arrLen, ok := parseProtoInt(line[1:])
+	if !ok || arrLen > PROTO_MAX_MULTIBULK_LEN {
+		return &ProtocolError{msg: "invalid multibulk length"}
+	}
+
+	// *0 and *-1 are valid, empty requests
+	if arrLen <= 0 {
+		return nil
+	}
+
+	v.array = make([]Value, 0, min(arrLen, 1024))
 	for range arrLen {
-		bulk, err := v.readBulk(r)
+		bulk, err := v.readBulk(r, maxBulkLen)
 		if err != nil {
-			log.Println(err)
-			break
+			v.array = nil
+			return err
 		}
 		v.array = append(v.array, bulk)
 	}
@@ -64,22 +159,272 @@ func (v *Value) readArray(r *bufio.Reader) error {
 	return nil
 }
 
-func (v *Value) readBulk(r *bufio.Reader) (Value, error) {
-	line, err := readLine(r)
+func (v *Value) readBulk(r *bufio.Reader, maxBulkLen int64) (Value, error) {
+	line, err := readRequestLine(r, PROTO_INLINE_MAX_SIZE)
+	if err == errLineTooLong {
+		return Value{}, &ProtocolError{msg: "too big bulk count string"}
+	}
 	if err != nil {
 		return Value{}, err
 	}
 
-	n, err := strconv.Atoi(line[1:])
+	if len(line) == 0 || line[0] != '$' {
+		got := "EOL"
+		if len(line) > 0 {
+			got = line[:1]
+		}
+		return Value{}, &ProtocolError{msg: fmt.Sprintf("expected '$', got '%s'", got)}
+	}
+
+	n, ok := parseProtoInt(line[1:])
+	if !ok || n < 0 || n > maxBulkLen {
+		return Value{}, &ProtocolError{msg: "invalid bulk length"}
+	}
+
+	var data []byte
+	if n <= protoBulkPrealloc {
+		data = make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return Value{}, unexpectedEOF(err)
+		}
+	} else {
+		var buf bytes.Buffer
+		buf.Grow(protoBulkPrealloc)
+		if _, err := io.CopyN(&buf, r, n); err != nil {
+			return Value{}, unexpectedEOF(err)
+		}
+		data = buf.Bytes()
+	}
+
+	var crlf [2]byte
+	if _, err := io.ReadFull(r, crlf[:]); err != nil {
+		return Value{}, unexpectedEOF(err)
+	}
+	if crlf != [2]byte{'\r', '\n'} {
+		return Value{}, &ProtocolError{msg: "bulk string not terminated by CRLF"}
+	}
+
+	return Value{typ: BULK, bulk: string(data)}, nil
+}
+
+// requestBuffered reports whether r already holds a complete request, so it
+// can be read without blocking. Malformed input counts as complete, leaving
+// readArray to report the error.
+func requestBuffered(r *bufio.Reader) bool {
+	buf, _ := r.Peek(r.Buffered())
+	if len(buf) == 0 {
+		return false
+	}
+
+	cutLine := func(b []byte) ([]byte, []byte, bool) {
+		line, rest, ok := bytes.Cut(b, []byte("\n"))
+		return bytes.TrimSuffix(line, []byte("\r")), rest, ok
+	}
+
+	line, rest, ok := cutLine(buf)
+	if !ok {
+		return false
+	}
+	// blank lines are empty inline requests, as in readArray
+	if len(line) == 0 || line[0] != '*' {
+		return true // inline
+	}
+
+	n, ok := parseProtoInt(string(line[1:]))
+	if !ok {
+		return true
+	}
+
+	for range n {
+		line, rest, ok = cutLine(rest)
+		if !ok {
+			return false
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return true
+		}
+
+		size, ok := parseProtoInt(string(line[1:]))
+		if !ok || size < 0 {
+			return true
+		}
+		if int64(len(rest)) < size+2 {
+			return false
+		}
+		rest = rest[size+2:]
+	}
+
+	return true
+}
+
+// unexpectedEOF reports a stream that ends mid-frame as such, so it's not
+// mistaken for a clean disconnect between requests.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// read parses a single reply of any type. It's used when this server acts as
+// a client of another instance, so lengths are bounded like a request's.
+func (v *Value) read(r *bufio.Reader, maxBulkLen int64) error {
+	line, err := readLine(r)
 	if err != nil {
-		return Value{}, err
+		return err
+	}
+	if len(line) == 0 {
+		return errors.New("empty reply")
 	}
 
-	buf := make([]byte, n+2)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return Value{}, err
+	switch ValueType(line[:1]) {
+	case STRING:
+		v.typ, v.str = STRING, line[1:]
+	case ERROR:
+		v.typ, v.err = ERROR, line[1:]
+	case INTEGER:
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		v.typ, v.num = INTEGER, n
+	case BULK:
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			v.typ = NULL
+			return nil
+		}
+		if int64(n) > maxBulkLen {
+			return errors.New("invalid bulk length")
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		v.typ, v.bulk = BULK, string(buf[:n])
+	case ARRAY:
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			v.typ = NULL
+			return nil
+		}
+		if n > PROTO_MAX_MULTIBULK_LEN {
+			return errors.New("invalid multibulk length")
+		}
+		v.typ = ARRAY
+		v.array = make([]Value, n)
+		for i := range v.array {
+			if err := v.array[i].read(r, maxBulkLen); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unknown reply type")
 	}
 
-	bulk := string(buf[:n])
-	return Value{typ: BULK, bulk: bulk}, nil
+	return nil
+}
+
+// splitInlineArgs splits an inline request on whitespace. Double quoted
+// arguments support the usual backslash escapes, including \xHH, while single
+// quoted ones only support \'.
+func splitInlineArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg strings.Builder
+		inDouble, inSingle := false, false
+
+	arg:
+		for ; ; i++ {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, &ProtocolError{msg: "unbalanced quotes in request"}
+				}
+				break
+			}
+
+			ch := line[i]
+			switch {
+			case inDouble:
+				switch {
+				case ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg.WriteByte(byte(b))
+					i += 3
+				case ch == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						arg.WriteByte('\n')
+					case 'r':
+						arg.WriteByte('\r')
+					case 't':
+						arg.WriteByte('\t')
+					case 'b':
+						arg.WriteByte('\b')
+					case 'a':
+						arg.WriteByte('\a')
+					default:
+						arg.WriteByte(line[i])
+					}
+				case ch == '"':
+					// a closing quote must be followed by a space or the end
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, &ProtocolError{msg: "unbalanced quotes in request"}
+					}
+					i++
+					break arg
+				default:
+					arg.WriteByte(ch)
+				}
+			case inSingle:
+				switch {
+				case ch == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					arg.WriteByte('\'')
+					i++
+				case ch == '\'':
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, &ProtocolError{msg: "unbalanced quotes in request"}
+					}
+					i++
+					break arg
+				default:
+					arg.WriteByte(ch)
+				}
+			case isInlineSpace(ch):
+				break arg
+			case ch == '"':
+				inDouble = true
+			case ch == '\'':
+				inSingle = true
+			default:
+				arg.WriteByte(ch)
+			}
+		}
+
+		args = append(args, arg.String())
+	}
+}
+
+func isInlineSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\v' || ch == '\f'
+}
+
+func isHex(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// buffered returns a reader that has already buffered all of s.
+func buffered(s string) *bufio.Reader {
+	r := bufio.NewReader(strings.NewReader(s))
+	r.Peek(len(s))
+	return r
+}
+
+func TestRequestBuffered(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"", false},
+		{"PING", false},
+		{"PING\r\n", true},
+		{"\r\n", true},
+		{"\n", true},
+		{"*1\r\n", false},
+		{"*1\r\n$4\r\nPI", false},
+		{"*1\r\n$4\r\nPING\r\n", true},
+		{"*1\r\n\r\n", true},
+		{"*x\r\n", true},
+	}
+
+	for _, tt := range tests {
+		if got := requestBuffered(buffered(tt.in)); got != tt.want {
+			t.Errorf("requestBuffered(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPipelinedBlankLine(t *testing.T) {
+	// a blank line after a command used to crash the request loop
+	r := buffered("PING\r\n\r\n")
+
+	var cmds []string
+	for {
+		v := Value{}
+		if err := v.readArray(r, PROTO_MAX_BULK_LEN); err != nil {
+			t.Fatal(err)
+		}
+		if len(v.array) > 0 {
+			cmds = append(cmds, v.array[0].bulk)
+		}
+		if !requestBuffered(r) {
+			break
+		}
+	}
+
+	if len(cmds) != 1 || cmds[0] != "PING" {
+		t.Errorf("read %q", cmds)
+	}
+}
+
+var fuzzSeeds = []string{
+	"PING\r\n",
+	"PING\r\n\r\n",
+	"set k \"a\\x41\" 'b'\n",
+	"*1\r\n$4\r\nPING\r\n",
+	"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*1\r\n$4\r\nPING\r\n",
+	"*0\r\n*-1\r\n",
+	"*1\r\n$-1\r\n",
+	"*1\r\n$4\r\nPINGxx",
+	"*3\r\n$3\r\nSET\r\n",
+	"*99999999999\r\n",
+	"*1\r\n$99999999999\r\n",
+	"*1\r\n:1\r\n",
+	"\"unbalanced\r\n",
+}
+
+func FuzzReadArray(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for {
+			v := Value{}
+			if err := v.readArray(r, 1024); err != nil {
+				return
+			}
+
+			var size int
+			for _, arg := range v.array {
+				if arg.typ != BULK {
+					t.Fatalf("argument of type %q", arg.typ)
+				}
+				size += len(arg.bulk)
+			}
+			if size > len(data) {
+				t.Fatalf("read %d bytes of arguments from %d bytes", size, len(data))
+			}
+		}
+	})
+}
+
+func FuzzRequestBuffered(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// requestBuffered only looks at what the reader holds
+		if len(data) > 4096 {
+			return
+		}
+		// drain requests the way the request loop does. A buffered request
+		// reads without waiting for more data, so it never runs into the
+		// end of the input.
+		r := buffered(string(data))
+		for requestBuffered(r) {
+			v := Value{}
+			err := v.readArray(r, PROTO_MAX_BULK_LEN)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				t.Fatalf("requestBuffered(%q) = true, but readArray needs more data: %v", data, err)
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
@@ -2,49 +2,190 @@ package main
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
 	"io"
 	"log"
+	"math"
+	"strconv"
 )
 
+// Writer streams RESP straight into a buffered writer. It's meant to be kept
+// for the lifetime of a connection: nothing is allocated per reply, and the
+// first error is remembered and returned by every later call, like bufio.
 type Writer struct {
-	writer io.Writer
+	writer  bufferedWriter
+	proto   int
+	scratch []byte
+	err     error
+}
+
+// bufferedWriter is satisfied by both *bufio.Writer and *bytes.Buffer
+type bufferedWriter interface {
+	io.Writer
+	io.StringWriter
 }
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: bufio.NewWriter(w)}
+	return &Writer{writer: bufio.NewWriter(w), proto: 2, scratch: make([]byte, 0, 32)}
+}
+
+// NewBufferWriter encodes into b, which is never flushed anywhere. Clients
+// use it to hold replies until their connection can take them.
+func NewBufferWriter(b *bytes.Buffer) *Writer {
+	return &Writer{writer: b, proto: 2, scratch: make([]byte, 0, 32)}
 }
 
-func (w *Writer) Deserialize(v *Value) (reply string) {
+func (w *Writer) Write(v *Value) error {
+	if v.stream != nil {
+		v.stream(w)
+		return w.err
+	}
+
 	switch v.typ {
 	case ARRAY:
-		reply = fmt.Sprintf("*%d\r\n", len(v.array))
-		for _, sub := range v.array {
-			reply += w.Deserialize(&sub)
+		w.WriteArrayLen(len(v.array))
+		for i := range v.array {
+			w.Write(&v.array[i])
 		}
 	case STRING:
-		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.str)
+		w.WriteSimple(v.str)
 	case INTEGER:
-		reply = fmt.Sprintf("%s%d\r\n", v.typ, v.num)
+		w.WriteInteger(int64(v.num))
 	case BULK:
-		reply = fmt.Sprintf("%s%d\r\n%s\r\n", v.typ, len(v.bulk), v.bulk)
+		w.WriteBulk(v.bulk)
 	case ERROR:
-		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.err)
+		w.WriteError(v.err)
 	case NULL:
-		reply = "$-1\r\n"
+		w.WriteNull()
+	case MAP, PUSH:
+		w.writeAggregate(v.typ, v.array)
+	case DOUBLE:
+		w.WriteDouble(v.double)
 	default:
 		log.Println("invalid typ received")
-		return reply
 	}
 
-	return reply
+	return w.err
+}
+
+// writeAggregate writes the RESP3 aggregates, which RESP2 connections receive
+// as flat arrays. Maps hold alternating keys and values.
+func (w *Writer) writeAggregate(typ ValueType, elems []Value) {
+	switch {
+	case w.proto < 3:
+		w.WriteArrayLen(len(elems))
+	case typ == MAP:
+		w.writeHeader(typ, int64(len(elems)/2))
+	default:
+		w.writeHeader(typ, int64(len(elems)))
+	}
+
+	for i := range elems {
+		w.Write(&elems[i])
+	}
+}
+
+// WriteArrayLen starts an array of n elements, which the caller then writes
+// one at a time. This lets large replies be produced without building them
+// as a []Value first.
+func (w *Writer) WriteArrayLen(n int) {
+	w.writeHeader(ARRAY, int64(n))
+}
+
+func (w *Writer) WriteBulk(s string) {
+	w.writeHeader(BULK, int64(len(s)))
+	w.writeString(s)
+	w.writeString("\r\n")
+}
+
+func (w *Writer) WriteSimple(s string) {
+	w.writeLine(STRING, s)
+}
+
+func (w *Writer) WriteError(s string) {
+	w.writeLine(ERROR, s)
+}
+
+func (w *Writer) WriteInteger(n int64) {
+	w.writeHeader(INTEGER, n)
+}
+
+func (w *Writer) WriteNull() {
+	if w.proto >= 3 {
+		w.writeString("_\r\n")
+	} else {
+		w.writeString("$-1\r\n")
+	}
+}
+
+func (w *Writer) WriteDouble(f float64) {
+	if w.proto < 3 {
+		// the header shares scratch, so the digits are formatted after it
+		w.writeHeader(BULK, int64(len(appendDouble(w.scratch[:0], f))))
+	} else {
+		w.writeString(string(DOUBLE))
+	}
+	w.scratch = appendDouble(w.scratch[:0], f)
+	w.writeBytes(w.scratch)
+	w.writeString("\r\n")
+}
+
+func appendDouble(b []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(b, "inf"...)
+	case math.IsInf(f, -1):
+		return append(b, "-inf"...)
+	case math.IsNaN(f):
+		return append(b, "nan"...)
+	}
+	return strconv.AppendFloat(b, f, 'g', -1, 64)
+}
+
+// writeHeader writes a type marker followed by a number, such as "*3\r\n".
+func (w *Writer) writeHeader(typ ValueType, n int64) {
+	w.scratch = append(w.scratch[:0], typ...)
+	w.scratch = strconv.AppendInt(w.scratch, n, 10)
+	w.scratch = append(w.scratch, '\r', '\n')
+	w.writeBytes(w.scratch)
+}
+
+func (w *Writer) writeLine(typ ValueType, s string) {
+	w.writeString(string(typ))
+	w.writeString(s)
+	w.writeString("\r\n")
+}
+
+func (w *Writer) writeString(s string) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.writer.WriteString(s)
+}
+
+func (w *Writer) writeBytes(b []byte) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.writer.Write(b)
 }
 
-func (w *Writer) Write(v *Value) {
-	reply := w.Deserialize(v)
-	w.writer.Write([]byte(reply))
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if bw, ok := w.writer.(*bufio.Writer); ok {
+		w.err = bw.Flush()
+	}
+	return w.err
 }
 
-func (w *Writer) Flush() {
-	w.writer.(*bufio.Writer).Flush()
+func (w *Writer) Buffered() int {
+	switch bw := w.writer.(type) {
+	case *bufio.Writer:
+		return bw.Buffered()
+	case *bytes.Buffer:
+		return bw.Len()
+	}
+	return 0
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+// legacyDeserialize is the encoder replies used to go through, kept to
+// compare the writer against.
+func legacyDeserialize(v *Value) (reply string) {
+	switch v.typ {
+	case ARRAY:
+		reply = fmt.Sprintf("*%d\r\n", len(v.array))
+		for _, sub := range v.array {
+			reply += legacyDeserialize(&sub)
+		}
+	case STRING:
+		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.str)
+	case INTEGER:
+		reply = fmt.Sprintf("%s%d\r\n", v.typ, v.num)
+	case BULK:
+		reply = fmt.Sprintf("%s%d\r\n%s\r\n", v.typ, len(v.bulk), v.bulk)
+	case ERROR:
+		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.err)
+	case NULL:
+		reply = "$-1\r\n"
+	}
+	return reply
+}
+
+// legacyWrite writes v the old way, with a new bufio.Writer per reply.
+func legacyWrite(w io.Writer, v *Value) {
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte(legacyDeserialize(v)))
+	bw.Flush()
+}
+
+func keysReply(n int) (*Value, []string) {
+	matches := make([]string, n)
+	for i := range matches {
+		matches[i] = fmt.Sprintf("key:%d", i)
+	}
+
+	v := &Value{typ: ARRAY}
+	for _, m := range matches {
+		v.array = append(v.array, Value{typ: BULK, bulk: m})
+	}
+	return v, matches
+}
+
+var smallReplies = []*Value{
+	{typ: STRING, str: "OK"},
+	{typ: INTEGER, num: 42},
+	{typ: BULK, bulk: "value"},
+	{typ: NULL},
+	{typ: ERROR, err: "ERR invalid command"},
+}
+
+func TestWriterMatchesLegacy(t *testing.T) {
+	keys, _ := keysReply(100)
+	values := append([]*Value{keys, {typ: ARRAY}}, smallReplies...)
+
+	for _, v := range values {
+		var b bytes.Buffer
+		if err := NewBufferWriter(&b).Write(v); err != nil {
+			t.Fatal(err)
+		}
+		if want := legacyDeserialize(v); b.String() != want {
+			t.Errorf("wrote %q, want %q", b.String(), want)
+		}
+	}
+}
+
+func BenchmarkWriterKeys(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		v, matches := keysReply(n)
+
+		b.Run(fmt.Sprintf("legacy/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				legacyWrite(io.Discard, v)
+			}
+		})
+
+		// as KEYS replies: streamed from the matches, without a []Value
+		b.Run(fmt.Sprintf("stream/%d", n), func(b *testing.B) {
+			var out bytes.Buffer
+			w := NewBufferWriter(&out)
+			stream := &Value{typ: ARRAY, stream: func(w *Writer) {
+				w.WriteArrayLen(len(matches))
+				for _, m := range matches {
+					w.WriteBulk(m)
+				}
+			}}
+
+			b.ReportAllocs()
+			for b.Loop() {
+				out.Reset()
+				w.Write(stream)
+			}
+		})
+	}
+}
+
+func BenchmarkWriterSmallReplies(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for _, v := range smallReplies {
+				legacyWrite(io.Discard, v)
+			}
+		}
+	})
+
+	b.Run("buffer", func(b *testing.B) {
+		var out bytes.Buffer
+		w := NewBufferWriter(&out)
+
+		b.ReportAllocs()
+		for b.Loop() {
+			out.Reset()
+			for _, v := range smallReplies {
+				w.Write(v)
+			}
+		}
+	})
+}
+
+func TestWriterRESP3(t *testing.T) {
+	mapReply := &Value{typ: MAP, array: []Value{{typ: BULK, bulk: "k"}, {typ: INTEGER, num: 1}}}
+	push := &Value{typ: PUSH, array: []Value{{typ: BULK, bulk: "message"}, {typ: BULK, bulk: "ch"}}}
+
+	tests := []struct {
+		v     *Value
+		resp2 string
+		resp3 string
+	}{
+		{mapReply, "*2\r\n$1\r\nk\r\n:1\r\n", "%1\r\n$1\r\nk\r\n:1\r\n"},
+		{push, "*2\r\n$7\r\nmessage\r\n$2\r\nch\r\n", ">2\r\n$7\r\nmessage\r\n$2\r\nch\r\n"},
+		{&Value{typ: DOUBLE, double: 1.5}, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{&Value{typ: DOUBLE, double: math.Inf(-1)}, "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{&Value{typ: NULL}, "$-1\r\n", "_\r\n"},
+	}
+
+	for _, tt := range tests {
+		for proto, want := range map[int]string{2: tt.resp2, 3: tt.resp3} {
+			var b bytes.Buffer
+			w := NewBufferWriter(&b)
+			w.proto = proto
+			if err := w.Write(tt.v); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != want {
+				t.Errorf("RESP%d wrote %q, want %q", proto, b.String(), want)
+			}
+		}
+	}
+}